@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// groupBuild is a prepared docker build for a build group
+type groupBuild struct {
+	buildGroup
+	containerPath   string
+	args            []string
+	dockerfileInput string
+	cleanup         func()
+}
+
+// buildFailure is a build that failed with the error
+type buildFailure struct {
+	build groupBuild
+	err   error
+}
+
+// runGroupBuilds runs the builds with at most concurrency builds at the same time and returns the failed ones; with multiple
+// builds the output of each is prefixed with its dockerfile, and all builds run to the end before returning; the output is
+// written to buildLog as well if it's set, and lines matching the filters are only dropped from the console
+func runGroupBuilds(builds []groupBuild, concurrency int, buildLog io.Writer, filters []*regexp.Regexp) []buildFailure {
+	if len(builds) == 1 {
+		logInfo("Building docker image %v...\n", builds[0].containerPath)
+		stdout := newFilterWriter(os.Stdout, filters, "")
+		stderr := newFilterWriter(os.Stderr, filters, "")
+		err := runBuild(builds[0], teeOutput(stdout, buildLog), teeOutput(stderr, buildLog))
+		stdout.Flush()
+		stderr.Flush()
+		if err != nil {
+			return []buildFailure{{build: builds[0], err: err}}
+		}
+		return nil
+	}
+
+	var outputMutex sync.Mutex
+	var failuresMutex sync.Mutex
+	var failures []buildFailure
+	var waitGroup sync.WaitGroup
+	workers := make(chan struct{}, concurrency)
+
+	for _, b := range builds {
+		waitGroup.Add(1)
+		go func(b groupBuild) {
+			defer waitGroup.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			logInfo("Building docker image %v from %v...\n", b.containerPath, b.dockerfile)
+			prefix := fmt.Sprintf("[%v] ", b.dockerfile)
+			// the prefix writer writes complete lines, so the filter writers never hold back part of a line
+			stdout := newPrefixWriter(teeOutput(newFilterWriter(os.Stdout, filters, prefix), buildLog), prefix, &outputMutex)
+			stderr := newPrefixWriter(teeOutput(newFilterWriter(os.Stderr, filters, prefix), buildLog), prefix, &outputMutex)
+			err := runBuild(b, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+
+			if err != nil {
+				failuresMutex.Lock()
+				failures = append(failures, buildFailure{build: b, err: err})
+				failuresMutex.Unlock()
+			}
+		}(b)
+	}
+	waitGroup.Wait()
+
+	return failures
+}
+
+func runBuild(b groupBuild, stdout, stderr io.Writer) error {
+	args := withDockerGlobalFlags(b.args)
+	logDebug("Running command 'docker %v'...", strings.Join(args, " "))
+	cmd := exec.Command("docker", args...)
+	cmd.Dir = workingDirectory
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if b.dockerfileInput != "" {
+		cmd.Stdin = strings.NewReader(b.dockerfileInput)
+	}
+	return cmd.Run()
+}
+
+// teeOutput returns a writer that writes to the build log as well if it's set
+func teeOutput(output, buildLog io.Writer) io.Writer {
+	if buildLog == nil {
+		return output
+	}
+	return io.MultiWriter(output, buildLog)
+}
+
+// getDebugBuildArgs replaces the tags in the docker build arguments with the debug references and builds the debug stage instead;
+// the build context stays the last argument
+func getDebugBuildArgs(args []string, stage string, debugReferences []string) []string {
+	var debugArgs []string
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "--tag" {
+			i++
+			continue
+		}
+		debugArgs = append(debugArgs, args[i])
+	}
+	debugArgs = append(debugArgs, "--target", stage)
+	for _, r := range debugReferences {
+		debugArgs = append(debugArgs, "--tag", r)
+	}
+	return append(debugArgs, args[len(args)-1])
+}
+
+// lineWriter buffers the written bytes and passes every complete line to writeLine
+type lineWriter struct {
+	writeLine func(line []byte)
+	buffer    bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+	for {
+		line, err := w.buffer.ReadBytes('\n')
+		if err != nil {
+			// keep the incomplete line until the rest of it is written
+			w.buffer.Reset()
+			w.buffer.Write(line)
+			return len(p), nil
+		}
+		w.writeLine(line)
+	}
+}
+
+// Flush writes the remaining incomplete line
+func (w *lineWriter) Flush() {
+	if w.buffer.Len() > 0 {
+		w.writeLine(append(w.buffer.Bytes(), '\n'))
+		w.buffer.Reset()
+	}
+}
+
+// prefixWriter writes every complete line with a prefix, holding the mutex shared with other writers so lines don't interleave
+type prefixWriter struct {
+	lineWriter
+	writer io.Writer
+	prefix string
+	mutex  *sync.Mutex
+}
+
+func newPrefixWriter(writer io.Writer, prefix string, mutex *sync.Mutex) *prefixWriter {
+	w := &prefixWriter{writer: writer, prefix: prefix, mutex: mutex}
+	w.lineWriter.writeLine = w.writePrefixedLine
+	return w
+}
+
+func (w *prefixWriter) writePrefixedLine(line []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writer.Write(append([]byte(w.prefix), line...))
+}
+
+// parseBuildLogFilters compiles the comma separated regexes of filterBuildLog
+func parseBuildLogFilters(filterBuildLog string) ([]*regexp.Regexp, error) {
+	var filters []*regexp.Regexp
+	for _, f := range splitPatterns(filterBuildLog) {
+		filter, err := regexp.Compile(f)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filterWriter drops the lines matching any of the filters, ignoring the prefix of prefixed lines; without filters everything is
+// written as is, without holding back incomplete lines
+type filterWriter struct {
+	lineWriter
+	writer  io.Writer
+	filters []*regexp.Regexp
+	prefix  string
+}
+
+func newFilterWriter(writer io.Writer, filters []*regexp.Regexp, prefix string) *filterWriter {
+	w := &filterWriter{writer: writer, filters: filters, prefix: prefix}
+	w.lineWriter.writeLine = w.writeUnfilteredLine
+	return w
+}
+
+func (w *filterWriter) Write(p []byte) (int, error) {
+	if len(w.filters) == 0 {
+		return w.writer.Write(p)
+	}
+	return w.lineWriter.Write(p)
+}
+
+func (w *filterWriter) writeUnfilteredLine(line []byte) {
+	text := strings.TrimPrefix(strings.TrimRight(string(line), "\r\n"), w.prefix)
+	for _, f := range w.filters {
+		if f.MatchString(text) {
+			return
+		}
+	}
+	w.writer.Write(line)
+}
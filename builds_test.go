@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	t.Run("PrefixesEveryCompleteLine", func(t *testing.T) {
+
+		var buffer bytes.Buffer
+		var mutex sync.Mutex
+		writer := newPrefixWriter(&buffer, "[Dockerfile] ", &mutex)
+
+		// act
+		writer.Write([]byte("Step 1/2 : FROM alpine\nStep 2/2 "))
+		writer.Write([]byte(": COPY . .\n"))
+
+		assert.Equal(t, "[Dockerfile] Step 1/2 : FROM alpine\n[Dockerfile] Step 2/2 : COPY . .\n", buffer.String())
+	})
+
+	t.Run("WritesIncompleteLineOnFlush", func(t *testing.T) {
+
+		var buffer bytes.Buffer
+		var mutex sync.Mutex
+		writer := newPrefixWriter(&buffer, "[Dockerfile] ", &mutex)
+		writer.Write([]byte("Successfully built 4b1f7e6b2d9c"))
+
+		// act
+		writer.Flush()
+
+		assert.Equal(t, "[Dockerfile] Successfully built 4b1f7e6b2d9c\n", buffer.String())
+	})
+}
+
+func TestFilterWriter(t *testing.T) {
+	t.Run("DropsLinesMatchingAnyFilter", func(t *testing.T) {
+
+		var buffer bytes.Buffer
+		writer := newFilterWriter(&buffer, []*regexp.Regexp{regexp.MustCompile(`^#\d+ sha256:`)}, "")
+
+		// act
+		writer.Write([]byte("#5 [1/2] FROM alpine\n#5 sha256:4fe2ade4 1.05MB / 2.8"))
+		writer.Write([]byte("MB 0.3s\n#6 [2/2] COPY . .\n"))
+
+		assert.Equal(t, "#5 [1/2] FROM alpine\n#6 [2/2] COPY . .\n", buffer.String())
+	})
+
+	t.Run("MatchesLinesWithoutPrefix", func(t *testing.T) {
+
+		var buffer bytes.Buffer
+		writer := newFilterWriter(&buffer, []*regexp.Regexp{regexp.MustCompile(`^#\d+ sha256:`)}, "[Dockerfile] ")
+
+		// act
+		writer.Write([]byte("[Dockerfile] #5 sha256:4fe2ade4 1.05MB / 2.8MB 0.3s\n[Dockerfile] #6 [2/2] COPY . .\n"))
+
+		assert.Equal(t, "[Dockerfile] #6 [2/2] COPY . .\n", buffer.String())
+	})
+}
+
+func TestParseBuildLogFilters(t *testing.T) {
+	t.Run("KeepsBackslashesFromFlagValue", func(t *testing.T) {
+
+		// act
+		filters, err := parseBuildLogFilters(`^#\d+ sha256:,^\s*$`)
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(filters)) {
+			assert.True(t, filters[0].MatchString("#5 sha256:4fe2ade4 1.05MB / 2.8MB 0.3s"))
+			assert.False(t, filters[0].MatchString("#d sha256:4fe2ade4"))
+			assert.True(t, filters[1].MatchString("  "))
+			assert.False(t, filters[1].MatchString("sss"))
+		}
+	})
+
+	t.Run("FiltersLinesWithPatternsFromFlagValue", func(t *testing.T) {
+
+		var buffer bytes.Buffer
+		filters, _ := parseBuildLogFilters(`^#\d+ sha256:`)
+		writer := newFilterWriter(&buffer, filters, "")
+
+		// act
+		writer.Write([]byte("#5 [1/2] FROM alpine\n#5 sha256:4fe2ade4 1.05MB / 2.8MB 0.3s\n"))
+
+		assert.Equal(t, "#5 [1/2] FROM alpine\n", buffer.String())
+	})
+
+	t.Run("ReturnsErrorForInvalidRegex", func(t *testing.T) {
+
+		// act
+		_, err := parseBuildLogFilters(`^(sha256`)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestTeeOutput(t *testing.T) {
+	t.Run("WritesToOutputAndBuildLog", func(t *testing.T) {
+
+		var output bytes.Buffer
+		var buildLog bytes.Buffer
+
+		// act
+		teeOutput(&output, &buildLog).Write([]byte("Step 1/2 : FROM alpine\n"))
+
+		assert.Equal(t, "Step 1/2 : FROM alpine\n", output.String())
+		assert.Equal(t, "Step 1/2 : FROM alpine\n", buildLog.String())
+	})
+
+	t.Run("ReturnsOutputWithoutBuildLog", func(t *testing.T) {
+
+		var output bytes.Buffer
+
+		// act
+		writer := teeOutput(&output, nil)
+
+		assert.Equal(t, &output, writer)
+	})
+}
+
+func TestGetDebugBuildArgs(t *testing.T) {
+	t.Run("ReplacesTagsWithDebugReferencesAndAddsTarget", func(t *testing.T) {
+
+		args := []string{"build", "--tag", "extensions/docker:1.0.0", "--tag", "extensions/docker:dev", "--build-arg", "CI=true", "--file", "./Dockerfile", "."}
+
+		// act
+		debugArgs := getDebugBuildArgs(args, "test", []string{"extensions/docker:debug"})
+
+		assert.Equal(t, []string{"build", "--build-arg", "CI=true", "--file", "./Dockerfile", "--target", "test", "--tag", "extensions/docker:debug", "."}, debugArgs)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// capabilitiesOutput is the json printed by the capabilities flag, for tooling to detect which features this version supports
+type capabilitiesOutput struct {
+	Version   string   `json:"version"`
+	Branch    string   `json:"branch"`
+	Revision  string   `json:"revision"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Actions   []string `json:"actions"`
+	Flags     []string `json:"flags"`
+}
+
+func writeCapabilities(w io.Writer, app *kingpin.Application) error {
+	capabilities := capabilitiesOutput{
+		Version:   version,
+		Branch:    branch,
+		Revision:  revision,
+		BuildDate: buildDate,
+		GoVersion: goVersion,
+		Actions:   validActions,
+	}
+	for _, f := range app.Model().Flags {
+		if !f.Hidden {
+			capabilities.Flags = append(capabilities.Flags, f.Name)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(capabilities)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCapabilities(t *testing.T) {
+	t.Run("WritesActionsAndFlagsAsJSON", func(t *testing.T) {
+
+		app := kingpin.New("test", "")
+		app.Flag("action", "").String()
+		app.Flag("hidden", "").Hidden().String()
+		var buffer bytes.Buffer
+
+		// act
+		err := writeCapabilities(&buffer, app)
+
+		assert.Nil(t, err)
+		var capabilities capabilitiesOutput
+		json.Unmarshal(buffer.Bytes(), &capabilities)
+		assert.Contains(t, capabilities.Actions, "build")
+		assert.Contains(t, capabilities.Flags, "action")
+		assert.NotContains(t, capabilities.Flags, "hidden")
+	})
+}
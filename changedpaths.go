@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// getChangedFiles returns the files changed since the common ancestor of the base ref and HEAD, using git in the working directory
+func getChangedFiles(baseRef string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", baseRef+"...HEAD")
+	cmd.Dir = workingDirectory
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var changedFiles []string
+	for _, f := range strings.Split(string(output), "\n") {
+		if f = strings.TrimSpace(f); f != "" {
+			changedFiles = append(changedFiles, f)
+		}
+	}
+	return changedFiles, nil
+}
+
+// getWatchedChanges returns the changed files that are one of the watched paths or in one of the watched directories
+func getWatchedChanges(changedFiles, watchPaths []string) []string {
+	var watchedChanges []string
+	for _, f := range changedFiles {
+		for _, p := range watchPaths {
+			p = filepath.ToSlash(filepath.Clean(strings.TrimSpace(p)))
+			if p == "." || f == p || strings.HasPrefix(f, p+"/") {
+				watchedChanges = append(watchedChanges, f)
+				break
+			}
+		}
+	}
+	return watchedChanges
+}
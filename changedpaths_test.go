@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetWatchedChanges(t *testing.T) {
+	t.Run("ReturnsChangedFilesInWatchedDirectories", func(t *testing.T) {
+
+		changedFiles := []string{"services/api/main.go", "services/api-gateway/main.go", "README.md", "Dockerfile"}
+
+		// act
+		watchedChanges := getWatchedChanges(changedFiles, []string{"./services/api/", "Dockerfile"})
+
+		assert.Equal(t, []string{"services/api/main.go", "Dockerfile"}, watchedChanges)
+	})
+
+	t.Run("ReturnsNoFilesIfNoWatchedPathChanged", func(t *testing.T) {
+
+		// act
+		watchedChanges := getWatchedChanges([]string{"docs/index.md"}, []string{"services/api"})
+
+		assert.Empty(t, watchedChanges)
+	})
+}
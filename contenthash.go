@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// getContentHashTag returns a tag derived from the sha256 of all files in the build context, which includes the Dockerfile and
+// everything copied into it; the relative path, mode and content of each file (or target of each symlink) are hashed in lexical
+// order, and the .git directory and push state file are skipped because they change without affecting the image
+func getContentHashTag(buildContextPath string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.Walk(buildContextPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == pushStateFile {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(buildContextPath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%v\x00%v\x00", relativePath, info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, link)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(hash, file)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Hashing build context %v failed: %v", buildContextPath, err)
+	}
+
+	return "src-" + hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetContentHashTag(t *testing.T) {
+	t.Run("ReturnsSameTagForSameContent", func(t *testing.T) {
+
+		buildContextPath, _ := ioutil.TempDir("", "build-context")
+		defer os.RemoveAll(buildContextPath)
+		ioutil.WriteFile(filepath.Join(buildContextPath, "Dockerfile"), []byte("FROM scratch"), 0644)
+
+		// act
+		tag1, err1 := getContentHashTag(buildContextPath)
+		tag2, err2 := getContentHashTag(buildContextPath)
+
+		assert.Nil(t, err1)
+		assert.Nil(t, err2)
+		assert.Equal(t, tag1, tag2)
+		assert.Equal(t, 20, len(tag1))
+	})
+
+	t.Run("ReturnsDifferentTagIfFileChanges", func(t *testing.T) {
+
+		buildContextPath, _ := ioutil.TempDir("", "build-context")
+		defer os.RemoveAll(buildContextPath)
+		ioutil.WriteFile(filepath.Join(buildContextPath, "Dockerfile"), []byte("FROM scratch"), 0644)
+		tag1, _ := getContentHashTag(buildContextPath)
+		ioutil.WriteFile(filepath.Join(buildContextPath, "Dockerfile"), []byte("FROM alpine"), 0644)
+
+		// act
+		tag2, err := getContentHashTag(buildContextPath)
+
+		assert.Nil(t, err)
+		assert.NotEqual(t, tag1, tag2)
+	})
+
+	t.Run("IgnoresGitDirectory", func(t *testing.T) {
+
+		buildContextPath, _ := ioutil.TempDir("", "build-context")
+		defer os.RemoveAll(buildContextPath)
+		ioutil.WriteFile(filepath.Join(buildContextPath, "Dockerfile"), []byte("FROM scratch"), 0644)
+		tag1, _ := getContentHashTag(buildContextPath)
+		os.MkdirAll(filepath.Join(buildContextPath, ".git"), 0755)
+		ioutil.WriteFile(filepath.Join(buildContextPath, ".git", "HEAD"), []byte("ref: refs/heads/master"), 0644)
+
+		// act
+		tag2, err := getContentHashTag(buildContextPath)
+
+		assert.Nil(t, err)
+		assert.Equal(t, tag1, tag2)
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// downloadClient times out a stalled download instead of hanging the build step
+var downloadClient = &http.Client{Timeout: 5 * time.Minute}
+
+// copyToDirectory copies a file or directory into the target directory, like cp -r does
+func copyToDirectory(source, targetDirectory string, followSymlinks bool) error {
+	return copyPath(source, filepath.Join(targetDirectory, filepath.Base(source)), followSymlinks)
+}
+
+// parseCopyEntry splits a src:dest copy entry; dest is relative to the build context and is empty for a bare src
+func parseCopyEntry(entry string) (source, destination string, err error) {
+	sourceAndDestination := strings.SplitN(entry, ":", 2)
+	source = sourceAndDestination[0]
+	if source == "" {
+		return "", "", fmt.Errorf("Copy entry %v has no source", entry)
+	}
+	if len(sourceAndDestination) == 1 {
+		return source, "", nil
+	}
+
+	destination = sourceAndDestination[1]
+	if destination == "" || filepath.IsAbs(destination) {
+		return "", "", fmt.Errorf("Copy entry %v needs a relative destination", entry)
+	}
+	if cleaned := filepath.Clean(destination); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", "", fmt.Errorf("Copy entry %v has a destination outside of the build context", entry)
+	}
+	return source, destination, nil
+}
+
+// copyToDestination copies a file or directory to the destination relative to the target directory, creating intermediate
+// directories; a destination ending in a slash is a directory to copy into, an empty destination copies into the target directory
+func copyToDestination(source, targetDirectory, destination string, followSymlinks bool) error {
+	if destination == "" {
+		return copyToDirectory(source, targetDirectory, followSymlinks)
+	}
+
+	target := filepath.Join(targetDirectory, destination)
+	if strings.HasSuffix(destination, "/") {
+		target = filepath.Join(target, filepath.Base(source))
+	}
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+	return copyPath(source, target, followSymlinks)
+}
+
+func isURLCopyEntry(entry string) bool {
+	return strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "http://")
+}
+
+// parseURLCopyEntry splits a `url [dest] [sha256=checksum]` copy entry; without dest the file name is derived from the url
+func parseURLCopyEntry(entry string) (sourceURL, destination, checksum string, err error) {
+	fields := strings.Fields(entry)
+	sourceURL = fields[0]
+	parsedURL, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Copy entry %v has an invalid url: %v", entry, err)
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "sha256="):
+			checksum = strings.ToLower(strings.TrimPrefix(f, "sha256="))
+			if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(checksum) {
+				return "", "", "", fmt.Errorf("Copy entry %v has a checksum that isn't a sha256 in hex", entry)
+			}
+		case destination == "":
+			destination = f
+		default:
+			return "", "", "", fmt.Errorf("Copy entry %v has more than a url, destination and checksum", entry)
+		}
+	}
+
+	if destination == "" || strings.HasSuffix(destination, "/") {
+		// the path package clashes with the path flag, so take the last url path segment by hand
+		fileName := parsedURL.Path[strings.LastIndex(parsedURL.Path, "/")+1:]
+		if fileName == "" {
+			return "", "", "", fmt.Errorf("Copy entry %v needs a destination, the url has no file name", entry)
+		}
+		destination += fileName
+	}
+	if filepath.IsAbs(destination) {
+		return "", "", "", fmt.Errorf("Copy entry %v needs a relative destination", entry)
+	}
+	if cleaned := filepath.Clean(destination); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", "", "", fmt.Errorf("Copy entry %v has a destination outside of the build context", entry)
+	}
+	return sourceURL, destination, checksum, nil
+}
+
+// downloadToDestination downloads the url to the destination relative to the target directory and verifies the sha256 checksum if it's set
+func downloadToDestination(sourceURL, targetDirectory, destination, checksum string) error {
+	response, err := downloadClient.Get(sourceURL)
+	if err != nil {
+		return fmt.Errorf("Downloading %v failed: %v", sourceURL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Downloading %v failed with status %v", sourceURL, response.Status)
+	}
+
+	target := filepath.Join(targetDirectory, destination)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("Downloading %v to %v failed: %v", sourceURL, target, err)
+	}
+	targetFile, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("Downloading %v to %v failed: %v", sourceURL, target, err)
+	}
+	defer targetFile.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(targetFile, hash), response.Body)
+	if err != nil {
+		return fmt.Errorf("Downloading %v to %v failed: %v", sourceURL, target, err)
+	}
+
+	if checksum != "" && hex.EncodeToString(hash.Sum(nil)) != checksum {
+		os.Remove(target)
+		return fmt.Errorf("Downloading %v failed, the sha256 checksum is %v instead of %v", sourceURL, hex.EncodeToString(hash.Sum(nil)), checksum)
+	}
+	return nil
+}
+
+func copyPath(source, target string, followSymlinks bool) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return fmt.Errorf("Copying %v failed: %v", source, err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !followSymlinks {
+			return copySymlink(source, target)
+		}
+		info, err = os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("Copying %v failed, can't follow symlink: %v", source, err)
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		return copyDirectory(source, target, info.Mode(), followSymlinks)
+	case info.Mode().IsRegular():
+		return copyFile(source, target, info.Mode())
+	default:
+		return fmt.Errorf("Copying %v failed, file type %v is not supported", source, info.Mode()&os.ModeType)
+	}
+}
+
+func copyDirectory(source, target string, mode os.FileMode, followSymlinks bool) error {
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+
+	entries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return fmt.Errorf("Copying %v failed: %v", source, err)
+	}
+	for _, e := range entries {
+		err = copyPath(filepath.Join(source, e.Name()), filepath.Join(target, e.Name()), followSymlinks)
+		if err != nil {
+			return err
+		}
+	}
+
+	// set the mode after copying the contents, so read-only directories can still be filled
+	err = os.Chmod(target, preservedMode(mode))
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+
+	return nil
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("Copying %v failed: %v", source, err)
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+	defer targetFile.Close()
+
+	_, err = io.Copy(targetFile, sourceFile)
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+
+	// chmod explicitly, the mode passed to OpenFile is subject to the umask
+	err = targetFile.Chmod(preservedMode(mode))
+	if err != nil {
+		return fmt.Errorf("Copying %v to %v failed: %v", source, target, err)
+	}
+
+	return nil
+}
+
+func copySymlink(source, target string) error {
+	link, err := os.Readlink(source)
+	if err != nil {
+		return fmt.Errorf("Copying %v failed: %v", source, err)
+	}
+
+	// replace an existing target, like cp does
+	os.Remove(target)
+
+	err = os.Symlink(link, target)
+	if err != nil {
+		return fmt.Errorf("Copying symlink %v to %v failed: %v", source, target, err)
+	}
+
+	return nil
+}
+
+func preservedMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
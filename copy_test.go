@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyToDirectory(t *testing.T) {
+	t.Run("CopiesFilePreservingModeBits", func(t *testing.T) {
+
+		sourceDirectory, _ := ioutil.TempDir("", "copy-source")
+		defer os.RemoveAll(sourceDirectory)
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+		source := filepath.Join(sourceDirectory, "entrypoint.sh")
+		ioutil.WriteFile(source, []byte("#!/bin/sh"), 0755)
+
+		// act
+		err := copyToDirectory(source, targetDirectory, false)
+
+		assert.Nil(t, err)
+		info, _ := os.Stat(filepath.Join(targetDirectory, "entrypoint.sh"))
+		assert.Equal(t, os.FileMode(0755), info.Mode())
+	})
+
+	t.Run("CopiesDirectoryRecursively", func(t *testing.T) {
+
+		sourceDirectory, _ := ioutil.TempDir("", "copy-source")
+		defer os.RemoveAll(sourceDirectory)
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+		os.MkdirAll(filepath.Join(sourceDirectory, "config", "nested"), 0755)
+		ioutil.WriteFile(filepath.Join(sourceDirectory, "config", "nested", "app.yaml"), []byte("key: value"), 0644)
+
+		// act
+		err := copyToDirectory(filepath.Join(sourceDirectory, "config"), targetDirectory, false)
+
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadFile(filepath.Join(targetDirectory, "config", "nested", "app.yaml"))
+		assert.Equal(t, "key: value", string(content))
+	})
+
+	t.Run("RetainsSymlinkIfNotFollowingSymlinks", func(t *testing.T) {
+
+		sourceDirectory, _ := ioutil.TempDir("", "copy-source")
+		defer os.RemoveAll(sourceDirectory)
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+		os.Symlink("/etc/ssl/certs/ca-certificates.crt", filepath.Join(sourceDirectory, "ca-certificates.crt"))
+
+		// act
+		err := copyToDirectory(filepath.Join(sourceDirectory, "ca-certificates.crt"), targetDirectory, false)
+
+		assert.Nil(t, err)
+		link, _ := os.Readlink(filepath.Join(targetDirectory, "ca-certificates.crt"))
+		assert.Equal(t, "/etc/ssl/certs/ca-certificates.crt", link)
+	})
+
+	t.Run("CopiesSymlinkTargetIfFollowingSymlinks", func(t *testing.T) {
+
+		sourceDirectory, _ := ioutil.TempDir("", "copy-source")
+		defer os.RemoveAll(sourceDirectory)
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+		ioutil.WriteFile(filepath.Join(sourceDirectory, "original.txt"), []byte("content"), 0644)
+		os.Symlink(filepath.Join(sourceDirectory, "original.txt"), filepath.Join(sourceDirectory, "link.txt"))
+
+		// act
+		err := copyToDirectory(filepath.Join(sourceDirectory, "link.txt"), targetDirectory, true)
+
+		assert.Nil(t, err)
+		info, _ := os.Lstat(filepath.Join(targetDirectory, "link.txt"))
+		assert.True(t, info.Mode().IsRegular())
+	})
+
+	t.Run("ReturnsErrorIfSourceDoesNotExist", func(t *testing.T) {
+
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+
+		// act
+		err := copyToDirectory("/does-not-exist", targetDirectory, false)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestParseCopyEntry(t *testing.T) {
+	t.Run("ReturnsEmptyDestinationForBareSource", func(t *testing.T) {
+
+		// act
+		source, destination, err := parseCopyEntry("Dockerfile")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "Dockerfile", source)
+		assert.Equal(t, "", destination)
+	})
+
+	t.Run("ReturnsSourceAndDestination", func(t *testing.T) {
+
+		// act
+		source, destination, err := parseCopyEntry("config/app.yaml:etc/app/app.yaml")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "config/app.yaml", source)
+		assert.Equal(t, "etc/app/app.yaml", destination)
+	})
+
+	t.Run("ReturnsErrorForDestinationOutsideOfBuildContext", func(t *testing.T) {
+
+		// act
+		_, _, err := parseCopyEntry("config/app.yaml:../app.yaml")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestCopyToDestination(t *testing.T) {
+	t.Run("CreatesIntermediateDirectories", func(t *testing.T) {
+
+		sourceDirectory, _ := ioutil.TempDir("", "copy-source")
+		defer os.RemoveAll(sourceDirectory)
+		targetDirectory, _ := ioutil.TempDir("", "copy-target")
+		defer os.RemoveAll(targetDirectory)
+		source := filepath.Join(sourceDirectory, "app.yaml")
+		ioutil.WriteFile(source, []byte("key: value"), 0644)
+
+		// act
+		err := copyToDestination(source, targetDirectory, "etc/app/", false)
+
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadFile(filepath.Join(targetDirectory, "etc", "app", "app.yaml"))
+		assert.Equal(t, "key: value", string(content))
+	})
+}
+
+func TestParseURLCopyEntry(t *testing.T) {
+	t.Run("ReturnsFileNameFromURLAsDestination", func(t *testing.T) {
+
+		// act
+		sourceURL, destination, checksum, err := parseURLCopyEntry("https://pki.internal/ca/ca-bundle.pem")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "https://pki.internal/ca/ca-bundle.pem", sourceURL)
+		assert.Equal(t, "ca-bundle.pem", destination)
+		assert.Equal(t, "", checksum)
+	})
+
+	t.Run("ReturnsDestinationAndChecksum", func(t *testing.T) {
+
+		// act
+		_, destination, checksum, err := parseURLCopyEntry("https://pki.internal/ca/ca-bundle.pem certs/ sha256=E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "certs/ca-bundle.pem", destination)
+		assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", checksum)
+	})
+
+	t.Run("ReturnsErrorForInvalidChecksum", func(t *testing.T) {
+
+		// act
+		_, _, _, err := parseURLCopyEntry("https://pki.internal/ca/ca-bundle.pem sha256=abc")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestDownloadToDestination(t *testing.T) {
+	t.Run("DownloadsFileIfChecksumMatches", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("certificate"))
+		}))
+		defer server.Close()
+		targetDirectory, _ := ioutil.TempDir("", "download-target")
+		defer os.RemoveAll(targetDirectory)
+		hash := sha256.Sum256([]byte("certificate"))
+
+		// act
+		err := downloadToDestination(server.URL+"/ca.pem", targetDirectory, "certs/ca.pem", hex.EncodeToString(hash[:]))
+
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadFile(filepath.Join(targetDirectory, "certs", "ca.pem"))
+		assert.Equal(t, "certificate", string(content))
+	})
+
+	t.Run("ReturnsErrorIfChecksumDoesNotMatch", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("tampered"))
+		}))
+		defer server.Close()
+		targetDirectory, _ := ioutil.TempDir("", "download-target")
+		defer os.RemoveAll(targetDirectory)
+		hash := sha256.Sum256([]byte("certificate"))
+
+		// act
+		err := downloadToDestination(server.URL+"/ca.pem", targetDirectory, "ca.pem", hex.EncodeToString(hash[:]))
+
+		assert.NotNil(t, err)
+		_, statErr := os.Stat(filepath.Join(targetDirectory, "ca.pem"))
+		assert.True(t, os.IsNotExist(statErr))
+	})
+
+	t.Run("ReturnsErrorForHTTPErrorStatus", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+		targetDirectory, _ := ioutil.TempDir("", "download-target")
+		defer os.RemoveAll(targetDirectory)
+
+		// act
+		err := downloadToDestination(server.URL+"/ca.pem", targetDirectory, "ca.pem", "")
+
+		assert.NotNil(t, err)
+		_, statErr := os.Stat(filepath.Join(targetDirectory, "ca.pem"))
+		assert.True(t, os.IsNotExist(statErr))
+	})
+
+	t.Run("ReturnsErrorIfServerStalls", func(t *testing.T) {
+
+		stalled := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-stalled
+		}))
+		defer server.Close()
+		defer close(stalled)
+		defaultDownloadClient := downloadClient
+		downloadClient = &http.Client{Timeout: 100 * time.Millisecond}
+		defer func() { downloadClient = defaultDownloadClient }()
+		targetDirectory, _ := ioutil.TempDir("", "download-target")
+		defer os.RemoveAll(targetDirectory)
+
+		// act
+		err := downloadToDestination(server.URL+"/ca.pem", targetDirectory, "ca.pem", "")
+
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// log levels in increasing order of severity, messages below the level set with logLevel are suppressed
+var logLevels = []string{"debug", "info", "warn"}
+
+func validateLogLevel(level string) {
+	if !contains(logLevels, level) {
+		failValidation("Set `logLevel:` to debug, info or warn, not `%v`", level)
+	}
+}
+
+func logDebug(format string, v ...interface{}) {
+	logAtLevel("debug", format, v...)
+}
+
+func logInfo(format string, v ...interface{}) {
+	logAtLevel("info", format, v...)
+}
+
+func logWarn(format string, v ...interface{}) {
+	logAtLevel("warn", "Warning: "+format, v...)
+}
+
+func logAtLevel(level, format string, v ...interface{}) {
+	if logLevelIndex(level) >= logLevelIndex(*logLevel) {
+		log.Print(redact(fmt.Sprintf(format, v...)))
+	}
+}
+
+// redactedValues are secret values that are replaced in all logging
+var redactedValues []string
+
+func addRedactedValue(value string) {
+	if value != "" {
+		redactedValues = append(redactedValues, value)
+	}
+}
+
+func redact(message string) string {
+	for _, v := range redactedValues {
+		message = strings.Replace(message, v, "***", -1)
+	}
+	return message
+}
+
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 0
+}
+
+// logFatal logs the error, prints it as annotation for the host CI if configured and exits
+func logFatal(format string, v ...interface{}) {
+	message := redact(fmt.Sprintf(format, v...))
+	if *ciAnnotations != "" {
+		fmt.Println(formatCIAnnotation(*ciAnnotations, message))
+	}
+	runRollbackOnFatal()
+	pushMetrics(false)
+	log.Fatal(message)
+}
+
+// formatCIAnnotation renders the message into the annotation format; annotations are single lines, so newlines are escaped
+// the way github workflow commands expect or replaced by spaces for other formats
+func formatCIAnnotation(format, message string) string {
+	message = strings.TrimSpace(message)
+	if format == "github" {
+		return "::error::" + strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(message)
+	}
+	return strings.Replace(format, "{message}", strings.NewReplacer("\r", " ", "\n", " ").Replace(message), -1)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatCIAnnotation(t *testing.T) {
+	t.Run("ReturnsGithubWorkflowCommandWithEscapedNewlines", func(t *testing.T) {
+
+		// act
+		annotation := formatCIAnnotation("github", "exit status 1\nbuild failed\n")
+
+		assert.Equal(t, "::error::exit status 1%0Abuild failed", annotation)
+	})
+
+	t.Run("ReturnsCustomFormatWithMessageOnSingleLine", func(t *testing.T) {
+
+		// act
+		annotation := formatCIAnnotation("##vso[task.logissue type=error]{message}", "exit status 1\nbuild failed")
+
+		assert.Equal(t, "##vso[task.logissue type=error]exit status 1 build failed", annotation)
+	})
+}
+
+func TestRedact(t *testing.T) {
+	t.Run("ReplacesRedactedValuesInMessage", func(t *testing.T) {
+
+		redactedValues = nil
+		addRedactedValue("s3cr3t")
+		addRedactedValue("")
+		defer func() { redactedValues = nil }()
+
+		// act
+		message := redact("docker build --build-arg TOKEN=s3cr3t .")
+
+		assert.Equal(t, "docker build --build-arg TOKEN=*** .", message)
+	})
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/alecthomas/kingpin"
 	contracts "github.com/estafette/estafette-ci-contracts"
@@ -24,7 +34,7 @@ var (
 
 var (
 	// flags
-	action       = kingpin.Flag("action", "Any of the following actions: build, push, tag.").Envar("ESTAFETTE_EXTENSION_ACTION").String()
+	action       = kingpin.Flag("action", "Any of the following actions: build, push, tag, build-and-push, exists, placeholder, sign.").Envar("ESTAFETTE_EXTENSION_ACTION").String()
 	repositories = kingpin.Flag("repositories", "List of the repositories the image needs to be pushed to or tagged in.").Envar("ESTAFETTE_EXTENSION_REPOSITORIES").String()
 	container    = kingpin.Flag("container", "Name of the container to build, defaults to app label if present.").Envar("ESTAFETTE_EXTENSION_CONTAINER").String()
 	tags         = kingpin.Flag("tags", "List of tags the image needs to receive.").Envar("ESTAFETTE_EXTENSION_TAGS").String()
@@ -32,19 +42,174 @@ var (
 	dockerfile   = kingpin.Flag("dockerfile", "Dockerfile to build, defaults to Dockerfile.").Default("Dockerfile").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_DOCKERFILE").String()
 	copy         = kingpin.Flag("copy", "List of files or directories to copy into the build directory.").Envar("ESTAFETTE_EXTENSION_COPY").String()
 	args         = kingpin.Flag("args", "List of build arguments to pass to the build.").Envar("ESTAFETTE_EXTENSION_ARGS").String()
+	labels       = kingpin.Flag("labels", "List of key=value labels to add to the image; wrap values containing commas in double quotes or escape them with a backslash.").Envar("ESTAFETTE_EXTENSION_LABELS").String()
+
+	repositoryTemplate       = kingpin.Flag("repositoryTemplate", "Template for the full image reference per repository, with {repository}, {container} and {tag} placeholders.").Default("{repository}/{container}:{tag}").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_REPOSITORY_TEMPLATE").String()
+	archSuffix               = kingpin.Flag("archSuffix", "Append the build architecture to each produced tag, like 1.0.0-amd64.").Envar("ESTAFETTE_EXTENSION_ARCH_SUFFIX").Bool()
+	useDockerConfig          = kingpin.Flag("useDockerConfig", "Rely on a mounted pre-authenticated docker config.json instead of logging in with the Estafette repository credentials.").Envar("ESTAFETTE_EXTENSION_USE_DOCKER_CONFIG").Bool()
+	failIfTagExists          = kingpin.Flag("failIfTagExists", "Fail before pushing if any of the tags already exists in a repository; the build version tag is exempt.").Envar("ESTAFETTE_EXTENSION_FAIL_IF_TAG_EXISTS").Bool()
+	buildMemory              = kingpin.Flag("buildMemory", "Memory limit for the build containers, like 2g.").Envar("ESTAFETTE_EXTENSION_BUILD_MEMORY").String()
+	buildCpus                = kingpin.Flag("buildCpus", "Number of cpus the build containers can use, like 1.5.").Envar("ESTAFETTE_EXTENSION_BUILD_CPUS").String()
+	pullSource               = kingpin.Flag("pullSource", "Pull the source image in the tag action; set to false to tag an image that already exists locally.").Default("true").Envar("ESTAFETTE_EXTENSION_PULL_SOURCE").Bool()
+	buildContexts            = kingpin.Flag("buildContexts", "List of additional named build contexts as name=path or name=docker-image://ref; requires BuildKit and docker cli 23.0 or newer.").Envar("ESTAFETTE_EXTENSION_BUILD_CONTEXTS").String()
+	pushLatest               = kingpin.Flag("pushLatest", "Additionally push the latest tag in the push and tag actions, unless the build version is a prerelease.").Envar("ESTAFETTE_EXTENSION_PUSH_LATEST").Bool()
+	pushLatestOnPrerelease   = kingpin.Flag("pushLatestOnPrerelease", "Push the latest tag for prerelease build versions as well when pushLatest is set.").Envar("ESTAFETTE_EXTENSION_PUSH_LATEST_ON_PRERELEASE").Bool()
+	copyFollowSymlinks       = kingpin.Flag("copyFollowSymlinks", "Copy the files symlinks point to instead of the symlinks themselves.").Envar("ESTAFETTE_EXTENSION_COPY_FOLLOW_SYMLINKS").Bool()
+	autoVersionLabel         = kingpin.Flag("autoVersionLabel", "Label the image with estafette.build.version=<build version>.").Envar("ESTAFETTE_EXTENSION_AUTO_VERSION_LABEL").Bool()
+	dockerConfigJSON         = kingpin.Flag("dockerConfigJSON", "Base64 encoded .dockerconfigjson, like in a Kubernetes image pull secret, to authenticate with.").Envar("ESTAFETTE_EXTENSION_DOCKER_CONFIG_JSON").String()
+	dateTag                  = kingpin.Flag("dateTag", "Add the current date as tag.").Envar("ESTAFETTE_EXTENSION_DATE_TAG").Bool()
+	dateTagLayout            = kingpin.Flag("dateTagLayout", "Go time layout used to format the date tag.").Default("2006-01-02").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_DATE_TAG_LAYOUT").String()
+	dateTagTimezone          = kingpin.Flag("dateTagTimezone", "Timezone used for the date tag, like Europe/Amsterdam.").Default("UTC").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_DATE_TAG_TIMEZONE").String()
+	actionRetries            = kingpin.Flag("actionRetries", "Number of times to retry the whole action when it fails for reasons other than invalid input.").Envar("ESTAFETTE_EXTENSION_ACTION_RETRIES").Int()
+	sortTags                 = kingpin.Flag("sortTags", "Process the tags in alphabetical order, with latest always last, instead of the order they are listed in.").Envar("ESTAFETTE_EXTENSION_SORT_TAGS").Bool()
+	addHosts                 = kingpin.Flag("addHosts", "List of host:ip mappings to add to /etc/hosts in the build containers; host-gateway resolves to the docker host.").Envar("ESTAFETTE_EXTENSION_ADD_HOSTS").String()
+	dockerConfigDir          = kingpin.Flag("dockerConfigDir", "Directory for the docker client config, including registry auth, to isolate it from other jobs on the same agent.").Envar("ESTAFETTE_EXTENSION_DOCKER_CONFIG_DIR").String()
+	argsPrefix               = kingpin.Flag("argsPrefix", "Pass all environment variables starting with this prefix as build arguments, with the prefix stripped; args listed explicitly take precedence.").Envar("ESTAFETTE_EXTENSION_ARGS_PREFIX").String()
+	outputFile               = kingpin.Flag("outputFile", "File to write a json summary of the action to.").Envar("ESTAFETTE_EXTENSION_OUTPUT_FILE").String()
+	retentionPolicy          = kingpin.Flag("retentionPolicy", "List of regex:keep or regex:expire rules deciding per pushed tag whether it is retained, included in the outputFile; the first matching rule wins, unmatched tags are kept.").Envar("ESTAFETTE_EXTENSION_RETENTION_POLICY").String()
+	minFreeDiskMB            = kingpin.Flag("minFreeDiskMB", "Fail early if the work directory volume has less free disk space than this number of megabytes.").Envar("ESTAFETTE_EXTENSION_MIN_FREE_DISK_MB").Int()
+	branchTag                = kingpin.Flag("branchTag", "Add the sanitized git branch as tag, prefixed with branchTagPrefix.").Envar("ESTAFETTE_EXTENSION_BRANCH_TAG").Bool()
+	branchTagPrefix          = kingpin.Flag("branchTagPrefix", "Prefix for the branch tag.").Default("branch-").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_BRANCH_TAG_PREFIX").String()
+	requireTags              = kingpin.Flag("requireTags", "Fail the push and tag actions if no tags besides the build version would be pushed.").Envar("ESTAFETTE_EXTENSION_REQUIRE_TAGS").Bool()
+	sourceImage              = kingpin.Flag("sourceImage", "Full reference of the source image for the tag action, like registry/repo/name:tag, instead of the build version in the first repository.").Envar("ESTAFETTE_EXTENSION_SOURCE_IMAGE").String()
+	skipIfUnchanged          = kingpin.Flag("skipIfUnchanged", "Skip the build and retag the existing image if an image for the same build context content hash already exists in the first repository.").Envar("ESTAFETTE_EXTENSION_SKIP_IF_UNCHANGED").Bool()
+	extraBuildArgs           = kingpin.Flag("extraBuildArgs", "Raw arguments appended to the docker build command, split like a shell would; these aren't validated and can conflict with the arguments set by this extension.").Envar("ESTAFETTE_EXTENSION_EXTRA_BUILD_ARGS").String()
+	pipelineTag              = kingpin.Flag("pipelineTag", "Add the sanitized pipeline name from ESTAFETTE_GIT_NAME as tag.").Envar("ESTAFETTE_EXTENSION_PIPELINE_TAG").Bool()
+	secrets                  = kingpin.Flag("secrets", "List of BuildKit secrets as id=path or id=env:VARIABLE, for use with RUN --mount=type=secret,id=<id> in the Dockerfile.").Envar("ESTAFETTE_EXTENSION_SECRETS").String()
+	sourceImageID            = kingpin.Flag("sourceImageId", "Id of a local image, like sha256:<digest>, to use as source for the push and tag actions instead of the build version tag.").Envar("ESTAFETTE_EXTENSION_SOURCE_IMAGE_ID").String()
+	credentialScope          = kingpin.Flag("credentialScope", "List of repository prefixes the repository credentials are restricted to; credentials for other repositories are not used.").Envar("ESTAFETTE_EXTENSION_CREDENTIAL_SCOPE").String()
+	injectSourceLabel        = kingpin.Flag("injectSourceLabel", "Label the image with org.opencontainers.image.source=https://<git source>/<git owner>/<git name>.").Envar("ESTAFETTE_EXTENSION_INJECT_SOURCE_LABEL").Bool()
+	isolation                = kingpin.Flag("isolation", "Isolation technology for the build containers: default, process or hyperv; only has effect on windows agents.").Envar("ESTAFETTE_EXTENSION_ISOLATION").String()
+	repositoriesFile         = kingpin.Flag("repositoriesFile", "File with newline or comma separated repositories, merged with the repositories.").Envar("ESTAFETTE_EXTENSION_REPOSITORIES_FILE").String()
+	pruneDangling            = kingpin.Flag("pruneDangling", "Remove dangling images after a successful build, keeping the build cache of tagged images.").Envar("ESTAFETTE_EXTENSION_PRUNE_DANGLING").Bool()
+	repositoryDockerfiles    = kingpin.Flag("repositoryDockerfiles", "Dockerfile to build per repository as repository=Dockerfile or repository=Dockerfile:container entries separated by semicolons; repositories without an entry use dockerfile and container.").Envar("ESTAFETTE_EXTENSION_REPOSITORY_DOCKERFILES").String()
+	labelFile                = kingpin.Flag("labelFile", "File with a key=value label per line to add to the image; labels set inline take precedence.").Envar("ESTAFETTE_EXTENSION_LABEL_FILE").String()
+	forceRm                  = kingpin.Flag("forceRm", "Always remove intermediate containers, even after a failed build; has no effect with BuildKit.").Envar("ESTAFETTE_EXTENSION_FORCE_RM").Bool()
+	removeIntermediate       = kingpin.Flag("removeIntermediate", "Remove intermediate containers after a successful build; set to false to keep them for debugging, has no effect with BuildKit.").Default("true").Envar("ESTAFETTE_EXTENSION_REMOVE_INTERMEDIATE").Bool()
+	placeholderBase          = kingpin.Flag("placeholderBase", "Base image for the placeholder action.").Default("scratch").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_PLACEHOLDER_BASE").String()
+	logLevel                 = kingpin.Flag("logLevel", "Minimum level of messages to log: debug, info or warn; the commands being run are logged at debug level.").Default("debug").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_LOG_LEVEL").String()
+	digestTag                = kingpin.Flag("digestTag", "Add a sha-<first 12 characters of the image id> tag in the push and tag actions.").Envar("ESTAFETTE_EXTENSION_DIGEST_TAG").Bool()
+	credentialsFile          = kingpin.Flag("credentialsFile", "File with repository credentials in the same json format as the Estafette credentials; these take precedence for repositories present in both.").Envar("ESTAFETTE_EXTENSION_CREDENTIALS_FILE").String()
+	referenceStyle           = kingpin.Flag("referenceStyle", "Shape of the image references: docker renders the repositoryTemplate, namespaced inserts the referenceNamespace between repository and container.").Default("docker").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_REFERENCE_STYLE").String()
+	referenceNamespace       = kingpin.Flag("referenceNamespace", "Project namespace segment for the namespaced referenceStyle.").Envar("ESTAFETTE_EXTENSION_REFERENCE_NAMESPACE").String()
+	digestOnly               = kingpin.Flag("digestOnly", "Only push the build version tag, which docker requires to push, and log the digest references to deploy by; additional tags are skipped.").Envar("ESTAFETTE_EXTENSION_DIGEST_ONLY").Bool()
+	environment              = kingpin.Flag("environment", "Environment to prefer repository credentials for; credentials with another environment are not used.").Envar("ESTAFETTE_EXTENSION_ENVIRONMENT").String()
+	requireFreshBase         = kingpin.Flag("requireFreshBase", "Compare the local base images from the Dockerfile with the registry before building and warn or fail when they are outdated.").Envar("ESTAFETTE_EXTENSION_REQUIRE_FRESH_BASE").String()
+	gatedTags                = kingpin.Flag("gatedTags", "List of tags, like stable or latest, that are only pushed when building one of the gatedTagBranches.").Envar("ESTAFETTE_EXTENSION_GATED_TAGS").String()
+	gatedTagBranches         = kingpin.Flag("gatedTagBranches", "List of branches the gatedTags are pushed for.").Default("main,master").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_GATED_TAG_BRANCHES").String()
+	httpProxy                = kingpin.Flag("httpProxy", "Proxy for http requests by the docker client and build stages; overrides the HTTP_PROXY environment variable.").Envar("ESTAFETTE_EXTENSION_HTTP_PROXY").String()
+	httpsProxy               = kingpin.Flag("httpsProxy", "Proxy for https requests by the docker client and build stages; overrides the HTTPS_PROXY environment variable.").Envar("ESTAFETTE_EXTENSION_HTTPS_PROXY").String()
+	noProxy                  = kingpin.Flag("noProxy", "Hosts to reach without proxy; overrides the NO_PROXY environment variable.").Envar("ESTAFETTE_EXTENSION_NO_PROXY").String()
+	ciAnnotations            = kingpin.Flag("ciAnnotations", "Format to print an annotation in for the host CI on errors, with a {message} placeholder, or github for ::error:: workflow commands.").Envar("ESTAFETTE_EXTENSION_CI_ANNOTATIONS").String()
+	longTags                 = kingpin.Flag("longTags", "What to do with tags over the maximum of 128 characters, fail or truncate.").Default("fail").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_LONG_TAGS").String()
+	buildkitFrontend         = kingpin.Flag("buildkitFrontend", "Dockerfile frontend image for BuildKit to build with, overriding the # syntax= directive in the Dockerfile.").Envar("ESTAFETTE_EXTENSION_BUILDKIT_FRONTEND").String()
+	requirePinnedFrontend    = kingpin.Flag("requirePinnedFrontend", "Warn when the Dockerfile frontend is not pinned to a digest or full x.y.z version.").Envar("ESTAFETTE_EXTENSION_REQUIRE_PINNED_FRONTEND").Bool()
+	signingKey               = kingpin.Flag("signingKey", "Cosign key to sign images with in the sign action, as path or kms uri; its password is read from COSIGN_PASSWORD.").Envar("ESTAFETTE_EXTENSION_SIGNING_KEY").String()
+	signKeyless              = kingpin.Flag("signKeyless", "Sign images in the sign action with cosign keyless signing instead of a signingKey.").Envar("ESTAFETTE_EXTENSION_SIGN_KEYLESS").Bool()
+	loginRetries             = kingpin.Flag("loginRetries", "Number of times to retry a docker login that fails with a transient error, with exponential backoff; authentication failures are not retried.").Envar("ESTAFETTE_EXTENSION_LOGIN_RETRIES").Int()
+	statusTag                = kingpin.Flag("statusTag", "Add a passed or failed tag for the build status read from ESTAFETTE_BUILD_STATUS.").Envar("ESTAFETTE_EXTENSION_STATUS_TAG").Bool()
+	registryHost             = kingpin.Flag("registryHost", "Registry host to prefix repositories without a host with.").Envar("ESTAFETTE_EXTENSION_REGISTRY_HOST").String()
+	prepareContext           = kingpin.Flag("prepareContext", "Create the path and copy the Dockerfile and copy entries into it; disable to build a pre-staged path as is.").Default("true").Envar("ESTAFETTE_EXTENSION_PREPARE_CONTEXT").Bool()
+	injectCiArgs             = kingpin.Flag("injectCiArgs", "Pass the CI, BUILD_VERSION, GIT_REVISION and GIT_BRANCH build args; args with the same name override them.").Envar("ESTAFETTE_EXTENSION_INJECT_CI_ARGS").Bool()
+	injectCiArgsExclude      = kingpin.Flag("injectCiArgsExclude", "List of build args injectCiArgs leaves out.").Envar("ESTAFETTE_EXTENSION_INJECT_CI_ARGS_EXCLUDE").String()
+	extraReferences          = kingpin.Flag("extraReferences", "List of complete registry/repository:tag references the image is additionally tagged and pushed to in the push and tag actions.").Envar("ESTAFETTE_EXTENSION_EXTRA_REFERENCES").String()
+	capabilities             = kingpin.Flag("capabilities", "Print the version, build metadata and supported actions and flags as json and exit.").Envar("ESTAFETTE_EXTENSION_CAPABILITIES").Bool()
+	forceRepush              = kingpin.Flag("forceRepush", "Push all references again on a retried run, instead of skipping the ones the push state file records as pushed.").Envar("ESTAFETTE_EXTENSION_FORCE_REPUSH").Bool()
+	extraTagsSourceImage     = kingpin.Flag("extraTagsSourceImage", "Complete reference of the image to tag and push the tags from in the tag action, instead of the source of the build version tag.").Envar("ESTAFETTE_EXTENSION_EXTRA_TAGS_SOURCE_IMAGE").String()
+	dockerfileStdin          = kingpin.Flag("dockerfileStdin", "Read the Dockerfile content from stdin and pass it to docker build instead of a Dockerfile in the path.").Envar("ESTAFETTE_EXTENSION_DOCKERFILE_STDIN").Bool()
+	dockerfileContent        = kingpin.Flag("dockerfileContent", "Dockerfile content to pass to docker build instead of a Dockerfile in the path.").Envar("ESTAFETTE_EXTENSION_DOCKERFILE_CONTENT").String()
+	credentialSecrets        = kingpin.Flag("credentialSecrets", "List of BuildKit secrets as id=credentialname.field, taking the field from an Estafette credential injected in an ESTAFETTE_CREDENTIALS_* environment variable.").Envar("ESTAFETTE_EXTENSION_CREDENTIAL_SECRETS").String()
+	sourcePullPolicy         = kingpin.Flag("sourcePullPolicy", "When to pull the source image in the tag action: always, if-not-present or never; takes precedence over pullSource.").Envar("ESTAFETTE_EXTENSION_SOURCE_PULL_POLICY").String()
+	metricsPushgateway       = kingpin.Flag("metricsPushgateway", "Url of a Prometheus Pushgateway to push the action duration, result and built image sizes to; failing to push is not fatal.").Envar("ESTAFETTE_EXTENSION_METRICS_PUSHGATEWAY").String()
+	baseImage                = kingpin.Flag("baseImage", "Base image passed as BASE_IMAGE build arg, for Dockerfiles with ARG BASE_IMAGE; its registry is logged in to if credentials are available.").Envar("ESTAFETTE_EXTENSION_BASE_IMAGE").String()
+	requireArgs              = kingpin.Flag("requireArgs", "Fail before building when an ARG before the first FROM in the Dockerfile has no default and isn't passed as build arg.").Envar("ESTAFETTE_EXTENSION_REQUIRE_ARGS").Bool()
+	prTag                    = kingpin.Flag("prTag", "Add a tag with the pull request number for pull request builds, which are detected by a number in the prTagEnvar environment variable.").Envar("ESTAFETTE_EXTENSION_PR_TAG").Bool()
+	prTagPrefix              = kingpin.Flag("prTagPrefix", "Prefix for the pull request number in the prTag.").Default("pr-").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_PR_TAG_PREFIX").String()
+	prTagEnvar               = kingpin.Flag("prTagEnvar", "Environment variable with the pull request number for prTag.").Default("ESTAFETTE_GIT_PULL_REQUEST").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_PR_TAG_ENVAR").String()
+	wrapEntrypoint           = kingpin.Flag("wrapEntrypoint", "Executable to layer on top of built images as entrypoint, called with the original entrypoint and command as arguments.").Envar("ESTAFETTE_EXTENSION_WRAP_ENTRYPOINT").String()
+	buildConcurrency         = kingpin.Flag("buildConcurrency", "Maximum number of Dockerfiles from repositoryDockerfiles to build at the same time.").Default("4").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_BUILD_CONCURRENCY").Int()
+	pushDebugOnFailure       = kingpin.Flag("pushDebugOnFailure", "Dockerfile stage to build and push under the debugTag when the build fails, for debugging; the step still fails.").Envar("ESTAFETTE_EXTENSION_PUSH_DEBUG_ON_FAILURE").String()
+	debugTag                 = kingpin.Flag("debugTag", "Tag to push the pushDebugOnFailure stage with.").Default("debug").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_DEBUG_TAG").String()
+	movingTagsLast           = kingpin.Flag("movingTagsLast", "Push and verify the build version tag in all repositories before moving any of the additional tags, like latest.").Envar("ESTAFETTE_EXTENSION_MOVING_TAGS_LAST").Bool()
+	secretArgs               = kingpin.Flag("secretArgs", "List of environment variables with decrypted Estafette secrets to pass as build args, with their values redacted from all logging.").Envar("ESTAFETTE_EXTENSION_SECRET_ARGS").String()
+	dockerHost               = kingpin.Flag("dockerHost", "Docker daemon endpoint to run all docker commands against, set as DOCKER_HOST (for example tcp://builder:2376).").Envar("ESTAFETTE_EXTENSION_DOCKER_HOST").String()
+	dockerContext            = kingpin.Flag("dockerContext", "Docker context to run all docker commands against, passed as --context.").Envar("ESTAFETTE_EXTENSION_DOCKER_CONTEXT").String()
+	buildLogFile             = kingpin.Flag("buildLogFile", "File to write the complete docker build output to in addition to the console, for archiving it as an artifact.").Envar("ESTAFETTE_EXTENSION_BUILD_LOG_FILE").String()
+	onlyIfChanged            = kingpin.Flag("onlyIfChanged", "Skip the action if none of the changedPaths changed since the base ref in changedPathsBaseRefEnvar; requires git and a clone that includes the base ref.").Envar("ESTAFETTE_EXTENSION_ONLY_IF_CHANGED").Bool()
+	changedPaths             = kingpin.Flag("changedPaths", "List of files and directories to check for changes with onlyIfChanged.").Envar("ESTAFETTE_EXTENSION_CHANGED_PATHS").String()
+	changedPathsBaseRefEnvar = kingpin.Flag("changedPathsBaseRefEnvar", "Environment variable with the git ref to compare against for onlyIfChanged.").Default("ESTAFETTE_GIT_BASE_REF").OverrideDefaultFromEnvar("ESTAFETTE_EXTENSION_CHANGED_PATHS_BASE_REF_ENVAR").String()
+	pinBaseDigests           = kingpin.Flag("pinBaseDigests", "Resolve the digest of each FROM image in the registry and build against a Dockerfile with the images pinned to those digests.").Envar("ESTAFETTE_EXTENSION_PIN_BASE_DIGESTS").Bool()
+	rollbackOnFailure        = kingpin.Flag("rollbackOnFailure", "Roll back the tags pushed by the tag action if it fails halfway, deleting new tags and pointing existing tags to their previous manifest again; deleting tags requires a registry that supports it through the registry api, like Google Container Registry and Artifact Registry, for others a warning is logged.").Envar("ESTAFETTE_EXTENSION_ROLLBACK_ON_FAILURE").Bool()
+	progress                 = kingpin.Flag("progress", "Type of BuildKit progress output passed to docker build as --progress: auto, plain or tty.").Envar("ESTAFETTE_EXTENSION_PROGRESS").String()
+	filterBuildLog           = kingpin.Flag("filterBuildLog", "List of regexes for lines to drop from the docker build output on the console; the buildLogFile still gets the full output.").Envar("ESTAFETTE_EXTENSION_FILTER_BUILD_LOG").String()
+	stageCacheRegistry       = kingpin.Flag("stageCacheRegistry", "Registry to push an image for each named intermediate stage to after building, which the next build uses as BuildKit cache with --cache-from; requires BuildKit and docker engine 19.03 or newer for the inline cache.").Envar("ESTAFETTE_EXTENSION_STAGE_CACHE_REGISTRY").String()
+	deleteVersionTag         = kingpin.Flag("deleteVersionTag", "Delete the build version tag from the registry after pushing with digestOnly, leaving only the digest reference; requires a registry that supports deleting tags through the registry api, like Google Container Registry and Artifact Registry, for others a warning is logged and the tag remains.").Envar("ESTAFETTE_EXTENSION_DELETE_VERSION_TAG").Bool()
+	digestReferencesFile     = kingpin.Flag("digestReferencesFile", "File to write the immutable repository@sha256 references of the pushed image to.").Envar("ESTAFETTE_EXTENSION_DIGEST_REFERENCES_FILE").String()
 )
 
+// buildVersionLabel is the label key used by autoVersionLabel
+const buildVersionLabel = "estafette.build.version"
+
+// sourceLabel is the label key used by injectSourceLabel
+const sourceLabel = "org.opencontainers.image.source"
+
+// contentHashLabel is the label key the build stores the content hash tag of skipIfUnchanged in, for the push action to read back
+const contentHashLabel = "estafette.contenthash"
+
 func main() {
 
 	// parse command line parameters
 	kingpin.Parse()
 
+	// print json only, so tooling can parse the output
+	if *capabilities {
+		err := writeCapabilities(os.Stdout, kingpin.CommandLine)
+		handleError(err)
+		os.Exit(0)
+	}
+
 	// log to stdout and hide timestamp
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 
+	validateLogLevel(*logLevel)
+
 	// log startup message
-	log.Printf("Starting estafette-extension-docker version %v...", version)
+	logInfo("Starting estafette-extension-docker version %v...", version)
+
+	// all actions shell out to the docker cli, exec errors for a missing binary are cryptic
+	if _, err := exec.LookPath("docker"); err != nil {
+		failValidation("The docker CLI was not found in PATH; run this extension in an image that has docker installed: %v", err)
+	}
+
+	// the proxy flags take precedence over proxy environment variables; the docker cli and all docker commands inherit the environment
+	for _, p := range getProxyVariables(*httpProxy, *httpsProxy, *noProxy) {
+		nameAndValue := strings.SplitN(p, "=", 2)
+		os.Setenv(nameAndValue[0], nameAndValue[1])
+	}
+
+	// point all docker commands at a remote daemon without relying on the agent environment
+	if *dockerHost != "" && *dockerContext != "" {
+		failValidation("Set either `dockerHost:` or `dockerContext:`, they can't be combined")
+	}
+	if *dockerHost != "" {
+		os.Setenv("DOCKER_HOST", *dockerHost)
+	}
+	if *dockerContext != "" {
+		if clientVersion := getDockerClientVersion(); !isVersionAtLeast(clientVersion, "19.03") {
+			failValidation("Set `dockerHost:` instead of `dockerContext:`, contexts need docker cli 19.03 or newer and this image has %v", clientVersion)
+		}
+	}
+
+	// check disk space before starting, a full disk makes builds fail halfway with confusing errors
+	if *minFreeDiskMB > 0 {
+		validateFreeDiskSpace(workingDirectory, *minFreeDiskMB)
+	}
+
+	// run the action in a child process that can be retried as a whole
+	if *actionRetries > 0 && os.Getenv(retryAttemptEnvar) == "" {
+		os.Exit(runActionWithRetries(*actionRetries))
+	}
 
 	// set defaults
 	appLabel := os.Getenv("ESTAFETTE_LABEL_APP")
@@ -52,21 +217,173 @@ func main() {
 		*container = appLabel
 	}
 
-	// get private container registries credentials
-	credentialsJSON := os.Getenv("ESTAFETTE_CI_REPOSITORY_CREDENTIALS_JSON")
+	// use a separate docker config directory for this job
+	if *dockerConfigDir != "" {
+		*dockerConfigDir = inWorkingDirectory(*dockerConfigDir)
+		logInfo("Ensuring docker config directory %v exists\n", *dockerConfigDir)
+		err := os.MkdirAll(*dockerConfigDir, 0700)
+		handleError(err)
+	}
+
+	// add the auths from a kubernetes style image pull secret to the docker config
+	if *dockerConfigJSON != "" {
+		dockerConfigPath := getDockerConfigPath()
+		logInfo("Adding auths from dockerConfigJSON to docker config %v\n", dockerConfigPath)
+		err := addDockerConfigJSONAuths(*dockerConfigJSON, dockerConfigPath)
+		handleError(err)
+	}
+
+	// get private container registries credentials, unless a mounted docker config takes care of authentication
 	var credentials []*contracts.ContainerRepositoryCredentialConfig
-	if credentialsJSON != "" {
-		json.Unmarshal([]byte(credentialsJSON), &credentials)
+	if *useDockerConfig {
+		dockerConfigPath := getDockerConfigPath()
+		validateDockerConfig(dockerConfigPath)
+		logInfo("Using mounted docker config %v, skipping login\n", dockerConfigPath)
+	} else {
+		credentialsJSON := os.Getenv("ESTAFETTE_CI_REPOSITORY_CREDENTIALS_JSON")
+		if credentialsJSON != "" {
+			credentials, _ = unmarshalCredentials([]byte(credentialsJSON), *environment)
+		}
+		if *credentialsFile != "" {
+			credentialsFileContent, err := ioutil.ReadFile(inWorkingDirectory(*credentialsFile))
+			if err != nil {
+				failValidation("Set `credentialsFile:` to a readable file: %v", err)
+			}
+			fileCredentials, err := unmarshalCredentials(credentialsFileContent, *environment)
+			if err != nil {
+				failValidation("Set `credentialsFile:` to a file with a json array of repository credentials: %v", err)
+			}
+			credentials = mergeCredentials(credentials, fileCredentials)
+		}
+	}
+
+	// merge repositories from file before validating them
+	repositoriesSlice := splitRepositories(*repositories)
+	if *repositoriesFile != "" {
+		repositoriesFileContent, err := ioutil.ReadFile(inWorkingDirectory(*repositoriesFile))
+		if err != nil {
+			failValidation("Set `repositoriesFile:` to a readable file: %v", err)
+		}
+		for _, r := range splitRepositories(string(repositoriesFileContent)) {
+			if !contains(repositoriesSlice, r) {
+				repositoriesSlice = append(repositoriesSlice, r)
+			}
+		}
+	}
+
+	if *registryHost != "" {
+		for i, r := range repositoriesSlice {
+			repositoriesSlice[i] = prefixRegistryHost(r, *registryHost)
+		}
 	}
 
 	// validate inputs
-	validateRepositories(*repositories)
+	validateRepositories(repositoriesSlice)
+	validateRetentionPolicy(*retentionPolicy)
+	retentionRules = parseRetentionPolicy(*retentionPolicy)
+	validateRepositoryTemplate(*repositoryTemplate)
+	validateReferenceStyle(*referenceStyle, *referenceNamespace, *repositoryTemplate)
+	repositoryDockerfilesMap, repositoryContainersMap, err := parseRepositoryDockerfiles(*repositoryDockerfiles)
+	if err != nil {
+		failValidation("Set `repositoryDockerfiles:` as `repository=Dockerfile;otherrepository=Dockerfile.other:othercontainer`: %v", err)
+	}
+	if *registryHost != "" {
+		prefixedRepositoryDockerfilesMap := map[string]string{}
+		for r, d := range repositoryDockerfilesMap {
+			prefixedRepositoryDockerfilesMap[prefixRegistryHost(r, *registryHost)] = d
+		}
+		repositoryDockerfilesMap = prefixedRepositoryDockerfilesMap
+		prefixedRepositoryContainersMap := map[string]string{}
+		for r, c := range repositoryContainersMap {
+			prefixedRepositoryContainersMap[prefixRegistryHost(r, *registryHost)] = c
+		}
+		repositoryContainersMap = prefixedRepositoryContainersMap
+	}
+	repositoryContainers = repositoryContainersMap
+	for r := range repositoryDockerfilesMap {
+		if !contains(repositoriesSlice, r) {
+			failValidation("Repository %v in `repositoryDockerfiles:` is not one of the `repositories:`", r)
+		}
+	}
+	if len(repositoryDockerfilesMap) > 0 && *skipIfUnchanged {
+		failValidation("Set either `repositoryDockerfiles:` or `skipIfUnchanged: true`, they can't be combined")
+	}
+	if len(repositoryDockerfilesMap) > 0 && *digestTag {
+		failValidation("Set either `repositoryDockerfiles:` or `digestTag: true`, they can't be combined")
+	}
+	// with a dockerfile per repository the repositories can have different images for the same tags
+	separateImages := len(repositoryDockerfilesMap) > 0 && *sourceImage == "" && *sourceImageID == ""
+	var extraReferencesSlice []string
+	if *extraReferences != "" {
+		extraReferencesSlice = strings.Split(*extraReferences, ",")
+	}
+	for _, r := range extraReferencesSlice {
+		if !isValidReferenceWithTag(r) {
+			failValidation("Set `extraReferences:` entries to complete references with a tag (for example like `- mirror.registry.io/extensions/docker:stable`), not `%v`", r)
+		}
+	}
+	if *deleteVersionTag && !*digestOnly {
+		failValidation("Set `digestOnly: true` to use `deleteVersionTag: true`, the build version tag is the only reference to the image otherwise")
+	}
+	if *dockerfileStdin && *dockerfileContent != "" {
+		failValidation("Set either `dockerfileStdin: true` or `dockerfileContent:`, they can't be combined")
+	}
+	if (*dockerfileStdin || *dockerfileContent != "") && len(repositoryDockerfilesMap) > 0 {
+		failValidation("Set either `repositoryDockerfiles:` or a Dockerfile from stdin or `dockerfileContent:`, they can't be combined")
+	}
+	if (*dockerfileStdin || *dockerfileContent != "") && *skipIfUnchanged {
+		failValidation("Set either `skipIfUnchanged: true` or a Dockerfile from stdin or `dockerfileContent:`, the content hash only covers files in the path")
+	}
+	if *dockerfileStdin && *actionRetries > 0 {
+		failValidation("Set `dockerfileContent:` instead of `dockerfileStdin: true` to use `actionRetries:`, stdin can only be read by the first attempt")
+	}
+	if *extraTagsSourceImage != "" && separateImages {
+		failValidation("Set either `repositoryDockerfiles:` or `extraTagsSourceImage:`, they can't be combined")
+	}
+	if len(extraReferencesSlice) > 0 && separateImages {
+		failValidation("Set either `repositoryDockerfiles:` or `extraReferences:`, they can't be combined")
+	}
+	validateBuildResources(*buildMemory, *buildCpus)
+	if *progress != "" && !contains([]string{"auto", "plain", "tty"}, *progress) {
+		failValidation("Set `progress:` to auto, plain or tty, not `%v`", *progress)
+	}
+	// the builder of older daemons ignores BUILDKIT_INLINE_CACHE, so the stage images would never give cache hits
+	if *stageCacheRegistry != "" && buildkitEnabled() {
+		if serverVersion := getDockerServerVersion(); !isVersionAtLeast(serverVersion, "19.03") {
+			failValidation("Remove `stageCacheRegistry:`, exporting inline cache needs docker engine 19.03 or newer and the daemon runs %v", serverVersion)
+		}
+	}
+	buildLogFilters, err := parseBuildLogFilters(*filterBuildLog)
+	if err != nil {
+		failValidation("Set `filterBuildLog:` entries to valid regexes: %v", err)
+	}
+	if *buildConcurrency < 1 {
+		failValidation("Set `buildConcurrency:` to at least 1, not `%v`", *buildConcurrency)
+	}
+	validateIsolation(*isolation)
+	if !contains([]string{"fail", "truncate"}, *longTags) {
+		failValidation("Set `longTags:` to fail or truncate, not `%v`", *longTags)
+	}
+	if *requireFreshBase != "" && !contains([]string{"warn", "fail"}, *requireFreshBase) {
+		failValidation("Set `requireFreshBase:` to warn or fail, not `%v`", *requireFreshBase)
+	}
+	if *sourcePullPolicy != "" && !contains([]string{"always", "if-not-present", "never"}, *sourcePullPolicy) {
+		failValidation("Set `sourcePullPolicy:` to always, if-not-present or never, not `%v`", *sourcePullPolicy)
+	}
+	validateBuildContexts(*buildContexts)
+	validateLabels(*labels)
+	validateAddHosts(*addHosts)
+	secretsSlice, err := parseSecrets(*secrets)
+	if err != nil {
+		failValidation("Set `secrets:` entries as `- id=path` or `- id=env:VARIABLE`: %v", err)
+	}
+	credentialSecretsSlice, err := parseCredentialSecrets(*credentialSecrets, os.Environ())
+	if err != nil {
+		failValidation("Set `credentialSecrets:` entries as `- id=credentialname.field` for credentials available to this step: %v", err)
+	}
+	secretsSlice = append(secretsSlice, credentialSecretsSlice...)
 
 	// split into arrays and set other variables
-	var repositoriesSlice []string
-	if *repositories != "" {
-		repositoriesSlice = strings.Split(*repositories, ",")
-	}
 	var tagsSlice []string
 	if *tags != "" {
 		tagsSlice = strings.Split(*tags, ",")
@@ -75,15 +392,185 @@ func main() {
 	if *copy != "" {
 		copySlice = strings.Split(*copy, ",")
 	}
+	for _, c := range copySlice {
+		if isURLCopyEntry(c) {
+			if _, _, _, err := parseURLCopyEntry(c); err != nil {
+				failValidation("Set `copy:` url entries as `- url [dest] [sha256=checksum]` with dest relative to the path: %v", err)
+			}
+		} else if _, _, err := parseCopyEntry(c); err != nil {
+			failValidation("Set `copy:` entries as `- src` or `- src:dest` with dest relative to the path: %v", err)
+		}
+	}
 	var argsSlice []string
 	if *args != "" {
 		argsSlice = strings.Split(*args, ",")
 	}
+	var secretArgsSlice []string
+	if *secretArgs != "" {
+		secretArgsSlice = strings.Split(*secretArgs, ",")
+	}
+	for _, a := range append(argsSlice, secretArgsSlice...) {
+		if isEncryptedSecret(os.Getenv(a)) {
+			failValidation("Environment variable %v holds an encrypted Estafette secret, which is only decrypted for the pipeline it was created for; create the secret for this pipeline", a)
+		}
+	}
+	for _, a := range secretArgsSlice {
+		addRedactedValue(os.Getenv(a))
+	}
+	labelsSlice := splitLabels(*labels)
+	if *labelFile != "" {
+		labelFileContent, err := ioutil.ReadFile(inWorkingDirectory(*labelFile))
+		if err != nil {
+			failValidation("Set `labelFile:` to a readable file: %v", err)
+		}
+		labelsSlice = mergeLabels(parseLabelFile(string(labelFileContent)), labelsSlice)
+	}
+	var addHostsSlice []string
+	if *addHosts != "" {
+		addHostsSlice = strings.Split(*addHosts, ",")
+	}
+	var buildContextsSlice []string
+	if *buildContexts != "" {
+		buildContextsSlice = strings.Split(*buildContexts, ",")
+	}
+	// docker build only has --build-context since it uses buildx by default, the cli in this image is older
+	if len(buildContextsSlice) > 0 && buildkitEnabled() {
+		if clientVersion := getDockerClientVersion(); !isVersionAtLeast(clientVersion, "23.0") {
+			failValidation("Remove `buildContexts:`, docker build only supports --build-context from docker cli 23.0 and this image has %v", clientVersion)
+		}
+	}
 	estafetteBuildVersion := os.Getenv("ESTAFETTE_BUILD_VERSION")
 	estafetteBuildVersionAsTag := tidyBuildVersionAsTag(estafetteBuildVersion)
 
+	// add the current date as tag
+	if *dateTag {
+		dateTagValue, err := getDateTag(time.Now(), *dateTagLayout, *dateTagTimezone)
+		if err != nil {
+			failValidation("%v", err)
+		}
+		tagsSlice = append(tagsSlice, dateTagValue)
+	}
+
+	// add a moving tag for the branch being built; the package level branch var is the branch of this extension itself, so it's not used
+	if *branchTag {
+		gitBranch := os.Getenv("ESTAFETTE_GIT_BRANCH")
+		if gitBranch != "" {
+			tagsSlice = append(tagsSlice, tidyBuildVersionAsTag(*branchTagPrefix+gitBranch))
+		} else {
+			logWarn("Skipping branch tag, ESTAFETTE_GIT_BRANCH is not set\n")
+		}
+	}
+
+	// add a tag for pull request preview images; builds without a pull request number aren't pull request builds
+	if *prTag {
+		if prTagValue := getPRTag(os.Getenv(*prTagEnvar), *prTagPrefix); prTagValue != "" {
+			tagsSlice = append(tagsSlice, prTagValue)
+		} else {
+			logInfo("Skipping pull request tag, %v has no pull request number\n", *prTagEnvar)
+		}
+	}
+
+	// add a tag identifying the pipeline, for repositories shared by multiple pipelines
+	if *pipelineTag {
+		gitName := os.Getenv("ESTAFETTE_GIT_NAME")
+		if gitName != "" {
+			tagsSlice = append(tagsSlice, tidyBuildVersionAsTag(gitName))
+		} else {
+			logWarn("Skipping pipeline tag, ESTAFETTE_GIT_NAME is not set\n")
+		}
+	}
+
+	// add a moving tag for the result of the build so far, for dashboards; this step has to run with `when: status == 'succeeded' || status == 'failed'` to see failed builds
+	if *statusTag {
+		buildStatus := os.Getenv("ESTAFETTE_BUILD_STATUS")
+		if statusTagValue := getStatusTag(buildStatus); statusTagValue != "" {
+			tagsSlice = append(tagsSlice, statusTagValue)
+		} else {
+			logWarn("Skipping status tag, ESTAFETTE_BUILD_STATUS is %v instead of succeeded or failed\n", buildStatus)
+		}
+	}
+
+	// add the latest tag for release builds
+	if *pushLatest && (*action == "push" || *action == "tag" || *action == "build-and-push") && !contains(tagsSlice, "latest") {
+		if !isPrereleaseVersion(estafetteBuildVersion) || *pushLatestOnPrerelease {
+			tagsSlice = append(tagsSlice, "latest")
+		} else {
+			logInfo("Not pushing latest tag for prerelease version %v\n", estafetteBuildVersion)
+			recordSkippedTag("latest", fmt.Sprintf("build version %v is a prerelease", estafetteBuildVersion))
+		}
+	}
+
+	// only push release tags from protected branches
+	if *gatedTags != "" {
+		gitBranch := os.Getenv("ESTAFETTE_GIT_BRANCH")
+		var skippedTags []string
+		tagsSlice, skippedTags = removeGatedTags(tagsSlice, strings.Split(*gatedTags, ","), strings.Split(*gatedTagBranches, ","), gitBranch)
+		for _, t := range skippedTags {
+			logInfo("Skipping tag %v, branch %v is not one of the gatedTagBranches %v\n", t, gitBranch, *gatedTagBranches)
+			recordSkippedTag(t, fmt.Sprintf("branch %v is not one of the gatedTagBranches", gitBranch))
+		}
+	}
+
+	if *sortTags {
+		sortTagsLatestLast(tagsSlice)
+	}
+
+	// suffix all tags with the architecture, so per-architecture images can be combined into a manifest list by their <tag>-<arch> names;
+	// the images are built for the architecture of the docker daemon, which can differ from the one this extension runs on
+	if *archSuffix {
+		serverArch := getDockerServerArch()
+		if serverArch == "" {
+			logFatal("Can't determine the architecture of the docker daemon for `archSuffix: true`")
+		}
+		estafetteBuildVersionAsTag, tagsSlice = suffixTagsWithArch(estafetteBuildVersionAsTag, tagsSlice, serverArch)
+	}
+
+	// check all produced tags, tags from branch names or prefixes can easily exceed the maximum length
+	if estafetteBuildVersionAsTag != "" {
+		estafetteBuildVersionAsTag, err = validateTag(estafetteBuildVersionAsTag, *longTags == "truncate")
+		if err != nil {
+			failValidation("%v", err)
+		}
+	}
+	for i, t := range tagsSlice {
+		tagsSlice[i], err = validateTag(t, *longTags == "truncate")
+		if err != nil {
+			failValidation("Set `tags:` to valid tags: %v", err)
+		}
+	}
+
+	// a tag equal to the build version tag, for example a branch tag when the build version is the branch name, would only be pushed twice
+	tagsSlice = removeDuplicateTags(tagsSlice, estafetteBuildVersionAsTag)
+
+	if *requireTags && len(tagsSlice) == 0 && (*action == "push" || *action == "tag" || *action == "build-and-push") {
+		failValidation("Set `tags:` to list at least one `- <tag>` (for example like `- dev`), `requireTags: true` doesn't allow pushing only the build version tag")
+	}
+
+	// in a monorepo only run the action if one of the watched paths changed
+	if *onlyIfChanged {
+		if *changedPaths == "" {
+			failValidation("Set `changedPaths:` to list the files and directories to check for changes with `onlyIfChanged: true`")
+		}
+		baseRef := os.Getenv(*changedPathsBaseRefEnvar)
+		if baseRef == "" {
+			logWarn("Running action, %v has no base ref to check for changed paths\n", *changedPathsBaseRefEnvar)
+		} else {
+			changedFiles, err := getChangedFiles(baseRef)
+			if err != nil {
+				logFatal("Determining files changed since %v with git failed, make sure git is installed and the clone includes %v: %v", baseRef, baseRef, err)
+			}
+			watchedChanges := getWatchedChanges(changedFiles, strings.Split(*changedPaths, ","))
+			if len(watchedChanges) == 0 {
+				logInfo("Skipping action %v, none of %v changed since %v\n", *action, *changedPaths, baseRef)
+				finishAction()
+				return
+			}
+			logInfo("Running action %v, %v changed since %v\n", *action, strings.Join(watchedChanges, ", "), baseRef)
+		}
+	}
+
 	switch *action {
-	case "build":
+	case "build", "build-and-push":
 
 		// minimal using defaults
 
@@ -114,48 +601,373 @@ func main() {
 		// args:
 		// - SOME_BUILD_ARG_ENVVAR
 
-		// make build dir if it doesn't exist
-		log.Printf("Ensuring build directory %v exists\n", *path)
-		runCommand("mkdir", []string{"-p", *path})
+		// a Dockerfile from stdin or content is passed to docker build as is, it isn't written to the path
+		inlineDockerfile := *dockerfileContent
+		if *dockerfileStdin {
+			stdinContent, err := ioutil.ReadAll(os.Stdin)
+			handleError(err)
+			inlineDockerfile = string(stdinContent)
+		}
+
+		// build once for each distinct dockerfile
+		buildGroups := groupRepositoriesByDockerfile(repositoriesSlice, *dockerfile, repositoryDockerfilesMap)
 
-		// add dockerfile to items to copy if path is non-default and dockerfile isn't in the list to copy already
-		if *path != "." && !contains(copySlice, *dockerfile) {
-			copySlice = append(copySlice, *dockerfile)
+		if *prepareContext {
+			// make build dir if it doesn't exist
+			logInfo("Ensuring build directory %v exists\n", *path)
+			runCommand("mkdir", []string{"-p", *path})
+
+			// add dockerfiles to items to copy if path is non-default and dockerfile isn't in the list to copy already
+			for _, g := range buildGroups {
+				if *path != "." && inlineDockerfile == "" && !contains(copySlice, g.dockerfile) {
+					copySlice = append(copySlice, g.dockerfile)
+				}
+			}
+
+			// copy files/dirs from copySlice to build path
+			for _, c := range copySlice {
+				if isURLCopyEntry(c) {
+					sourceURL, destination, checksum, _ := parseURLCopyEntry(c)
+					logInfo("Downloading %v to %v\n", sourceURL, filepath.Join(*path, destination))
+					err := downloadToDestination(sourceURL, inWorkingDirectory(*path), destination, checksum)
+					handleError(err)
+					continue
+				}
+				source, destination, _ := parseCopyEntry(c)
+				logInfo("Copying %v to %v\n", source, filepath.Join(*path, destination))
+				err := copyToDestination(inWorkingDirectory(source), inWorkingDirectory(*path), destination, *copyFollowSymlinks)
+				handleError(err)
+			}
+		} else if len(copySlice) > 0 {
+			logWarn("Ignoring copy entries %v, prepareContext is disabled\n", strings.Join(copySlice, ", "))
 		}
 
-		// copy files/dirs from copySlice to build path
-		for _, c := range copySlice {
-			log.Printf("Copying %v to %v\n", c, *path)
-			runCommand("cp", []string{"-r", c, *path})
+		// reuse a previously built image for the exact same build context
+		imageFromCache := false
+		contentHashTag := ""
+		if *skipIfUnchanged {
+			contentHashTag, err = getContentHashTag(inWorkingDirectory(*path))
+			handleError(err)
+			cachedContainerPath := getContainerPath(repositoriesSlice[0], getRepositoryContainer(repositoriesSlice[0]), contentHashTag)
+			loginIfRequired(credentials, cachedContainerPath)
+
+			logInfo("Checking whether container image %v already exists\n", cachedContainerPath)
+			if imageExistsInRegistry(cachedContainerPath) {
+				logInfo("Build context is unchanged, skipping build and tagging container image %v instead\n", cachedContainerPath)
+				recordSkippedBuild(getContainerPath(repositoriesSlice[0], getRepositoryContainer(repositoriesSlice[0]), estafetteBuildVersionAsTag), fmt.Sprintf("build context is unchanged since %v", cachedContainerPath))
+				runDockerCommand([]string{"pull", cachedContainerPath})
+				for _, r := range repositoriesSlice {
+					for _, t := range append([]string{estafetteBuildVersionAsTag}, tagsSlice...) {
+						runDockerCommand([]string{"tag", cachedContainerPath, getContainerPath(r, getRepositoryContainer(r), t)})
+					}
+				}
+				imageFromCache = true
+			} else if !contains(tagsSlice, contentHashTag) {
+				// tag the image with the content hash so the push action pushes it for the next build to find
+				tagsSlice = append(tagsSlice, contentHashTag)
+			}
 		}
 
-		// todo - check FROM statement to see whether login is required
-		containerPath := fmt.Sprintf("%v/%v:%v", repositoriesSlice[0], *container, estafetteBuildVersionAsTag)
-		loginIfRequired(credentials, containerPath)
+		if !imageFromCache {
+			// prepare all builds first, so invalid input fails before any build starts, then build the distinct dockerfiles concurrently
+			var builds []groupBuild
+			for _, g := range buildGroups {
+				// todo - check FROM statement to see whether login is required
+				containerPath := getContainerPath(g.repositories[0], getRepositoryContainer(g.repositories[0]), estafetteBuildVersionAsTag)
+				loginIfRequired(credentials, containerPath)
+
+				// a base image from a private registry can only be pulled by the build after logging in
+				if *baseImage != "" {
+					loginIfRequired(credentials, *baseImage)
+				}
 
-		// build docker image
-		log.Printf("Building docker image %v...\n", containerPath)
-		args := []string{
-			"build",
-		}
-		for _, r := range repositoriesSlice {
-			args = append(args, "--tag")
-			args = append(args, fmt.Sprintf("%v/%v:%v", r, *container, estafetteBuildVersionAsTag))
-			for _, t := range tagsSlice {
-				args = append(args, "--tag")
-				args = append(args, fmt.Sprintf("%v/%v:%v", r, *container, t))
+				if *requireFreshBase != "" {
+					dockerfileContent, err := readDockerfile(inlineDockerfile, g.dockerfile)
+					handleError(err)
+					for _, b := range getBaseImages(string(dockerfileContent)) {
+						if isBaseImageOutdated(credentials, b) {
+							if *requireFreshBase == "fail" {
+								logFatal("Base image %v is outdated, pull it to get the latest version from the registry", b)
+							}
+							logWarn("Base image %v is outdated, pull it to get the latest version from the registry\n", b)
+						}
+					}
+				}
+
+				// build against a generated dockerfile passed on stdin, so the build is reproducible with the base images at the resolved digests
+				buildDockerfileInput := inlineDockerfile
+				if *pinBaseDigests {
+					dockerfileContent, err := readDockerfile(inlineDockerfile, g.dockerfile)
+					handleError(err)
+					baseImageDigests := map[string]string{}
+					for _, b := range getBaseImages(string(dockerfileContent)) {
+						if strings.Contains(b, "@") {
+							continue
+						}
+						baseImageDigests[b] = getBaseImageDigest(credentials, b)
+						logInfo("Pinning base image %v to digest %v\n", b, baseImageDigests[b])
+					}
+					buildDockerfileInput = pinBaseImageDigests(string(dockerfileContent), baseImageDigests)
+				}
+
+				// build docker image
+				logInfo("Preparing build of docker image %v...\n", containerPath)
+				args := []string{
+					"build",
+				}
+				for _, r := range g.repositories {
+					args = append(args, "--tag")
+					args = append(args, getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag))
+					for _, t := range tagsSlice {
+						args = append(args, "--tag")
+						args = append(args, getContainerPath(r, getRepositoryContainer(r), t))
+					}
+				}
+				if *baseImage != "" {
+					args = append(args, "--build-arg", fmt.Sprintf("BASE_IMAGE=%v", *baseImage))
+				}
+
+				// pass the ci build args first, so explicitly set args with the same name take precedence
+				if *injectCiArgs {
+					for _, a := range getCiBuildArgs(estafetteBuildVersion, os.Getenv("ESTAFETTE_GIT_REVISION"), os.Getenv("ESTAFETTE_GIT_BRANCH"), strings.Split(*injectCiArgsExclude, ",")) {
+						args = append(args, "--build-arg", a)
+					}
+				}
+				for _, a := range append(argsSlice, secretArgsSlice...) {
+					argValue := os.Getenv(a)
+					args = append(args, "--build-arg")
+					args = append(args, fmt.Sprintf("%v=%v", a, argValue))
+				}
+				// docker build doesn't pass the proxy environment variables on to the build stages, only the predefined proxy build args
+				for _, p := range getProxyVariables(*httpProxy, *httpsProxy, *noProxy) {
+					args = append(args, "--build-arg", p)
+				}
+				if *argsPrefix != "" {
+					for _, a := range getPrefixedBuildArgs(os.Environ(), *argsPrefix) {
+						// explicitly listed args win over the prefixed ones
+						if contains(argsSlice, strings.SplitN(a, "=", 2)[0]) {
+							continue
+						}
+						args = append(args, "--build-arg", a)
+					}
+				}
+
+				for _, l := range labelsSlice {
+					args = append(args, "--label", l)
+				}
+				if contentHashTag != "" {
+					// files written into the build context after the build change the content hash, so the push action reads it from the image
+					args = append(args, "--label", fmt.Sprintf("%v=%v", contentHashLabel, contentHashTag))
+				}
+				if *autoVersionLabel {
+					// use the build version as is, only tags have a restricted character set
+					args = append(args, "--label", fmt.Sprintf("%v=%v", buildVersionLabel, estafetteBuildVersion))
+				}
+				if *injectSourceLabel {
+					sourceURL := getSourceURL(os.Getenv("ESTAFETTE_GIT_SOURCE"), os.Getenv("ESTAFETTE_GIT_OWNER"), os.Getenv("ESTAFETTE_GIT_NAME"))
+					if sourceURL != "" {
+						args = append(args, "--label", fmt.Sprintf("%v=%v", sourceLabel, sourceURL))
+					} else {
+						logWarn("Skipping source label, ESTAFETTE_GIT_SOURCE, ESTAFETTE_GIT_OWNER or ESTAFETTE_GIT_NAME is not set\n")
+					}
+				}
+
+				for _, h := range addHostsSlice {
+					args = append(args, "--add-host", h)
+				}
+
+				// BuildKit doesn't use intermediate containers, so these only apply to legacy builds
+				if *forceRm {
+					args = append(args, "--force-rm")
+				}
+				if !*removeIntermediate {
+					args = append(args, "--rm=false")
+				}
+
+				if *isolation != "" {
+					// linux daemons only support default isolation and ignore this
+					args = append(args, "--isolation", *isolation)
+				}
+				if *buildMemory != "" {
+					args = append(args, "--memory", *buildMemory)
+				}
+				if *buildCpus != "" {
+					// docker build has no --cpus flag, so translate it into a quota for the default cfs period
+					cpuQuota, _ := getCPUQuota(*buildCpus)
+					args = append(args, "--cpu-period", strconv.Itoa(cpuPeriod), "--cpu-quota", strconv.Itoa(cpuQuota))
+				}
+
+				if len(buildContextsSlice) > 0 {
+					if buildkitEnabled() {
+						for _, bc := range buildContextsSlice {
+							// BuildKit pulls docker-image:// contexts with the docker credentials, so private images need a login first
+							if contextImage := getBuildContextImage(bc); contextImage != "" {
+								loginForReference(credentials, contextImage)
+							}
+							args = append(args, "--build-context", bc)
+						}
+					} else {
+						logWarn("Ignoring buildContexts, they're only supported by BuildKit; set DOCKER_BUILDKIT=1 to enable it\n")
+					}
+				}
+
+				if *stageCacheRegistry != "" {
+					if buildkitEnabled() {
+						// the docker builder only exports registry cache inline, so each stage is pushed as an image with the cache metadata
+						dockerfileContent, err := readDockerfile(buildDockerfileInput, g.dockerfile)
+						handleError(err)
+						stageCacheArgs, stageCacheReferences := getStageCacheArgs(*stageCacheRegistry, getRepositoryContainer(g.repositories[0]), g.dockerfile, getBuildStages(string(dockerfileContent)))
+						for _, r := range stageCacheReferences {
+							loginForReference(credentials, r)
+						}
+						args = append(args, stageCacheArgs...)
+					} else {
+						logWarn("Ignoring stageCacheRegistry, it's only supported by BuildKit; set DOCKER_BUILDKIT=1 to enable it\n")
+					}
+				}
+
+				if *progress != "" {
+					if buildkitEnabled() {
+						args = append(args, "--progress", *progress)
+					} else {
+						logWarn("Ignoring progress, it's only supported by BuildKit; set DOCKER_BUILDKIT=1 to enable it\n")
+					}
+				}
+
+				if *buildkitFrontend != "" {
+					if buildkitEnabled() {
+						// the dockerfile frontend uses the BUILDKIT_SYNTAX build arg instead of the # syntax= directive if it's set
+						args = append(args, "--build-arg", fmt.Sprintf("BUILDKIT_SYNTAX=%v", *buildkitFrontend))
+					} else {
+						logWarn("Ignoring buildkitFrontend, it's only supported by BuildKit; set DOCKER_BUILDKIT=1 to enable it\n")
+					}
+				}
+				if *requirePinnedFrontend {
+					frontend := *buildkitFrontend
+					if frontend == "" {
+						dockerfileContent, err := readDockerfile(buildDockerfileInput, g.dockerfile)
+						handleError(err)
+						frontend = getSyntaxDirective(string(dockerfileContent))
+					}
+					if frontend == "" {
+						logWarn("No # syntax= directive in %v, the frontend built into the daemon is used\n", g.dockerfile)
+					} else if !isPinnedFrontend(frontend) {
+						logWarn("Frontend %v is not pinned to a digest or full x.y.z version\n", frontend)
+					}
+				}
+
+				cleanupSecrets := func() {}
+				if len(secretsSlice) > 0 {
+					if !buildkitEnabled() {
+						failValidation("Set DOCKER_BUILDKIT=1 to use `secrets:`, they're only supported by BuildKit")
+					}
+					err := validateSecretSources(secretsSlice)
+					if err != nil {
+						failValidation("%v", err)
+					}
+					dockerfileContent, err := readDockerfile(buildDockerfileInput, g.dockerfile)
+					handleError(err)
+					if unconsumedSecretIDs := getUnconsumedSecretIDs(string(dockerfileContent), secretsSlice); len(unconsumedSecretIDs) > 0 {
+						logWarn("Secrets %v are not used in a `RUN --mount=type=secret,id=<id>` instruction in %v\n", strings.Join(unconsumedSecretIDs, ", "), g.dockerfile)
+					}
+					if undeclaredSecretIDs := getUndeclaredSecretIDs(string(dockerfileContent), secretsSlice); len(undeclaredSecretIDs) > 0 {
+						logWarn("Secrets %v are used in %v, but not declared in `secrets:`\n", strings.Join(undeclaredSecretIDs, ", "), g.dockerfile)
+					}
+
+					var secretArgs []string
+					secretArgs, cleanupSecrets, err = getSecretArgs(secretsSlice)
+					handleError(err)
+					args = append(args, secretArgs...)
+				}
+
+				args = append(args, "--file")
+				if buildDockerfileInput != "" {
+					args = append(args, "-")
+				} else {
+					args = append(args, fmt.Sprintf("%v/%v", *path, g.dockerfile))
+				}
+				if *extraBuildArgs != "" {
+					extraBuildArgsSlice, err := splitArguments(*extraBuildArgs)
+					handleError(err)
+					logWarn("Adding unvalidated extraBuildArgs %v, these can conflict with arguments set by this extension\n", strings.Join(extraBuildArgsSlice, " "))
+					args = append(args, extraBuildArgsSlice...)
+				}
+				if *requireArgs {
+					dockerfileContent, err := readDockerfile(buildDockerfileInput, g.dockerfile)
+					handleError(err)
+					if missingArgs := getMissingBuildArgs(getRequiredBuildArgs(string(dockerfileContent)), args); len(missingArgs) > 0 {
+						failValidation("Set `args:` to pass %v, they have no default in %v", strings.Join(missingArgs, ", "), g.dockerfile)
+					}
+				}
+
+				args = append(args, *path)
+				builds = append(builds, groupBuild{buildGroup: g, containerPath: containerPath, args: args, dockerfileInput: buildDockerfileInput, cleanup: cleanupSecrets})
+			}
+
+			// stream the build output to the log file as well, so large logs are never held in memory
+			var buildLog io.Writer
+			if *buildLogFile != "" {
+				logInfo("Writing docker build output to %v\n", *buildLogFile)
+				buildLogWriter, err := os.Create(inWorkingDirectory(*buildLogFile))
+				handleError(err)
+				defer buildLogWriter.Close()
+				buildLog = buildLogWriter
+			}
+
+			// the temporary secret files are needed until the debug stages of failed builds and the stage cache images are built as well
+			failures := runGroupBuilds(builds, *buildConcurrency, buildLog, buildLogFilters)
+			var failedDockerfiles []string
+			for _, f := range failures {
+				failedDockerfiles = append(failedDockerfiles, fmt.Sprintf("%v: %v", f.build.dockerfile, f.err))
+				if *pushDebugOnFailure != "" {
+					pushDebugImage(credentials, f.build, buildLog)
+				}
+			}
+			if *stageCacheRegistry != "" && buildkitEnabled() && len(failures) == 0 {
+				for _, b := range builds {
+					pushStageCache(credentials, b)
+				}
+			}
+			for _, b := range builds {
+				b.cleanup()
+			}
+			if len(failures) > 0 {
+				logFatal("Building docker images failed for %v", strings.Join(failedDockerfiles, ", "))
+			}
+
+			for _, b := range builds {
+				if *wrapEntrypoint != "" {
+					var groupTags []string
+					for _, r := range b.repositories {
+						groupTags = append(groupTags, getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag))
+						for _, t := range tagsSlice {
+							groupTags = append(groupTags, getContainerPath(r, getRepositoryContainer(r), t))
+						}
+					}
+					wrapImageEntrypoint(b.containerPath, groupTags)
+				}
+				recordBuiltImage(b.containerPath)
+			}
+
+			if *pruneDangling {
+				pruneDanglingImages()
 			}
 		}
-		for _, a := range argsSlice {
-			argValue := os.Getenv(a)
-			args = append(args, "--build-arg")
-			args = append(args, fmt.Sprintf("%v=%v", a, argValue))
+
+		if *action == "build" {
+			break
 		}
 
-		args = append(args, "--file")
-		args = append(args, fmt.Sprintf("%v/%v", *path, *dockerfile))
-		args = append(args, *path)
-		runCommand("docker", args)
+		// image: extensions/docker:stable
+		// action: build-and-push
+		// container: docker
+		// repositories:
+		// - extensions
+		// tags:
+		// - dev
+
+		// continue with pushing the image that was just built
+		fallthrough
 
 	case "push":
 
@@ -167,58 +979,126 @@ func main() {
 		// tags:
 		// - dev
 
-		sourceContainerPath := fmt.Sprintf("%v/%v:%v", repositoriesSlice[0], *container, estafetteBuildVersionAsTag)
+		// or write the immutable repository@sha256 references to a file after pushing
+
+		// image: extensions/docker:stable
+		// action: push
+		// container: docker
+		// repositories:
+		// - extensions
+		// digestReferencesFile: digests.txt
+
+		// or push without mutable tags to deploy by digest; docker needs a tag to push, which can be deleted afterwards on
+		// registries that support deleting a single tag through the registry api, docker hub and the docker distribution
+		// registry only delete a manifest by digest with all its tags, so there the build version tag remains
+
+		// image: extensions/docker:stable
+		// action: push
+		// container: docker
+		// repositories:
+		// - extensions
+		// digestOnly: true
+		// deleteVersionTag: true
+
+		sourceContainerPath := getContainerPath(repositoriesSlice[0], getRepositoryContainer(repositoriesSlice[0]), estafetteBuildVersionAsTag)
+		if *sourceImageID != "" {
+			validateSourceImageID(*sourceImageID)
+			sourceContainerPath = *sourceImageID
+		}
+
+		// push the content hash tag so later builds of the same build context can be skipped; it's taken from the image, since the
+		// build context can have changed since the build, for example by files this extension writes
+		if *skipIfUnchanged {
+			contentHashTag := getImageLabel(sourceContainerPath, contentHashLabel)
+			if contentHashTag == "" {
+				logWarn("Skipping content hash tag, container image %v has no %v label; build it with skipIfUnchanged\n", sourceContainerPath, contentHashLabel)
+			} else if !contains(tagsSlice, contentHashTag) {
+				tagsSlice = append(tagsSlice, contentHashTag)
+			}
+		}
+
+		// the image id is only known once the image exists locally, so add the digest tag before tagging and pushing
+		if *digestTag {
+			tagsSlice = appendDigestTag(tagsSlice, sourceContainerPath)
+		}
+
+		if *digestOnly && len(tagsSlice) > 0 {
+			logWarn("Skipping tags %v, only the build version tag is pushed with digestOnly\n", strings.Join(tagsSlice, ", "))
+			for _, t := range tagsSlice {
+				recordSkippedTag(t, "only pushing the build version tag with digestOnly")
+			}
+			tagsSlice = nil
+		}
+
+		if *failIfTagExists {
+			validateTagsDontExist(credentials, repositoriesSlice, tagsSlice)
+		}
+
+		var digestReferences []string
 
 		// push each repository + tag combination
 		for i, r := range repositoriesSlice {
 
-			targetContainerPath := fmt.Sprintf("%v/%v:%v", r, *container, estafetteBuildVersionAsTag)
+			targetContainerPath := getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag)
+
+			// each repository has its own image if built from separate dockerfiles
+			repositorySourceContainerPath := sourceContainerPath
+			if separateImages {
+				repositorySourceContainerPath = targetContainerPath
+			}
 
-			if i > 0 {
-				// tag container with default tag (it already exists for the first repository)
-				log.Printf("Tagging container image %v\n", targetContainerPath)
+			if (i > 0 || *sourceImageID != "") && !separateImages {
+				// tag container with default tag (it already exists for the first repository, unless pushing a local image id)
+				logInfo("Tagging container image %v\n", targetContainerPath)
 				tagArgs := []string{
 					"tag",
 					sourceContainerPath,
 					targetContainerPath,
 				}
-				err := exec.Command("docker", tagArgs...).Run()
+				err := dockerCommand(tagArgs...).Run()
 				handleError(err)
 			}
 
 			loginIfRequired(credentials, targetContainerPath)
 
 			// push container with default tag
-			log.Printf("Pushing container image %v\n", targetContainerPath)
-			pushArgs := []string{
-				"push",
-				targetContainerPath,
+			pushContainerImage(targetContainerPath, estafetteBuildVersionAsTag)
+
+			if *digestReferencesFile != "" || *digestOnly {
+				// the repo digest only exists once the image has been pushed to this repository
+				digestReference := getRepoDigest(targetContainerPath, getContainerRepository(r, getRepositoryContainer(r)))
+				logInfo("Pushed container image %v as %v\n", targetContainerPath, digestReference)
+				digestReferences = append(digestReferences, digestReference)
 			}
-			runCommand("docker", pushArgs)
 
-			// push additional tags
-			for _, t := range tagsSlice {
+			if *deleteVersionTag {
+				logInfo("Deleting build version tag %v from the registry\n", targetContainerPath)
+				if err := deleteRegistryTag(getCredentialsForReference(credentials, targetContainerPath), targetContainerPath); err != nil {
+					logWarn("Deleting build version tag %v failed, it remains in the registry: %v\n", targetContainerPath, err)
+				}
+			}
 
-				targetContainerPath := fmt.Sprintf("%v/%v:%v", r, *container, t)
+			// push additional tags
+			if !*movingTagsLast {
+				pushAdditionalTags(credentials, repositorySourceContainerPath, r, tagsSlice)
+			}
+		}
 
-				// tag container with additional tag
-				log.Printf("Tagging container image %v\n", targetContainerPath)
-				tagArgs := []string{
-					"tag",
-					sourceContainerPath,
-					targetContainerPath,
+		if *movingTagsLast {
+			moveTagsAfterVerifying(credentials, repositoriesSlice, estafetteBuildVersionAsTag, func(r string) string {
+				if separateImages {
+					return getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag)
 				}
-				runCommand("docker", tagArgs)
+				return sourceContainerPath
+			}, tagsSlice)
+		}
 
-				loginIfRequired(credentials, targetContainerPath)
+		pushExtraReferences(credentials, sourceContainerPath, extraReferencesSlice)
 
-				log.Printf("Pushing container image %v\n", targetContainerPath)
-				pushArgs := []string{
-					"push",
-					targetContainerPath,
-				}
-				runCommand("docker", pushArgs)
-			}
+		if *digestReferencesFile != "" {
+			logInfo("Writing digest references to %v\n", *digestReferencesFile)
+			err := ioutil.WriteFile(inWorkingDirectory(*digestReferencesFile), []byte(strings.Join(digestReferences, "\n")+"\n"), 0644)
+			handleError(err)
 		}
 
 	case "tag":
@@ -232,133 +1112,1849 @@ func main() {
 		// - stable
 		// - latest
 
-		sourceContainerPath := fmt.Sprintf("%v/%v:%v", repositoriesSlice[0], *container, estafetteBuildVersionAsTag)
+		// or promote an image from a registry that isn't one of the target repositories
 
-		loginIfRequired(credentials, sourceContainerPath)
-
-		// pull source container first
-		log.Printf("Pulling container image %v\n", sourceContainerPath)
-		pullArgs := []string{
-			"pull",
-			sourceContainerPath,
+		// image: extensions/docker:stable
+		// action: tag
+		// container: docker
+		// sourceImage: staging.registry.io/extensions/docker:${ESTAFETTE_BUILD_VERSION}
+		// repositories:
+		// - extensions
+		// tags:
+		// - stable
+
+		// or take the tags from an already promoted image, while the build version tag comes from the source image
+
+		// image: extensions/docker:stable
+		// action: tag
+		// container: docker
+		// sourceImage: staging.registry.io/extensions/docker:${ESTAFETTE_BUILD_VERSION}
+		// extraTagsSourceImage: prerelease.registry.io/extensions/docker:${ESTAFETTE_BUILD_VERSION}
+		// repositories:
+		// - extensions
+		// tags:
+		// - stable
+
+		sourceContainerPath := getContainerPath(repositoriesSlice[0], getRepositoryContainer(repositoriesSlice[0]), estafetteBuildVersionAsTag)
+		if *sourceImage != "" {
+			sourceContainerPath = *sourceImage
+		}
+		if *sourceImageID != "" {
+			sourceContainerPath = *sourceImageID
+		}
+
+		if *failIfTagExists {
+			validateTagsDontExist(credentials, repositoriesSlice, tagsSlice)
+		}
+
+		// put back the tags pushed so far if any later step fails
+		if *rollbackOnFailure {
+			activeRollback = &tagRollback{credentials: credentials}
+		}
+
+		if *sourceImageID != "" {
+			// a local image id can't be pulled
+			validateSourceImageID(*sourceImageID)
+		} else if !separateImages {
+			// pull source container first
+			pullSourceImage(credentials, sourceContainerPath)
+		}
+
+		extraTagsSourceContainerPath := sourceContainerPath
+		if *extraTagsSourceImage != "" {
+			extraTagsSourceContainerPath = *extraTagsSourceImage
+			pullSourceImage(credentials, extraTagsSourceContainerPath)
+		}
+
+		// the image id is only known once the image has been pulled, so add the digest tag before tagging and pushing
+		if *digestTag {
+			tagsSlice = appendDigestTag(tagsSlice, extraTagsSourceContainerPath)
 		}
-		runCommand("docker", pullArgs)
 
 		// push each repository + tag combination
 		for i, r := range repositoriesSlice {
 
-			targetContainerPath := fmt.Sprintf("%v/%v:%v", r, *container, estafetteBuildVersionAsTag)
+			targetContainerPath := getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag)
+
+			// each repository has its own image if built from separate dockerfiles, so pull them one by one
+			if separateImages {
+				sourceContainerPath = targetContainerPath
+				extraTagsSourceContainerPath = targetContainerPath
+				pullSourceImage(credentials, sourceContainerPath)
+			}
 
-			if i > 0 {
+			// the first repository already has the default tag, unless the source image comes from elsewhere
+			if (i > 0 || *sourceImage != "" || *sourceImageID != "") && !separateImages {
 				// tag container with default tag
-				log.Printf("Tagging container image %v\n", targetContainerPath)
+				logInfo("Tagging container image %v\n", targetContainerPath)
 				tagArgs := []string{
 					"tag",
 					sourceContainerPath,
 					targetContainerPath,
 				}
-				runCommand("docker", tagArgs)
+				runDockerCommand(tagArgs)
 
 				loginIfRequired(credentials, targetContainerPath)
 
 				// push container with default tag
-				log.Printf("Pushing container image %v\n", targetContainerPath)
-				pushArgs := []string{
-					"push",
-					targetContainerPath,
-				}
-				runCommand("docker", pushArgs)
+				pushContainerImage(targetContainerPath, estafetteBuildVersionAsTag)
 			}
 
 			// push additional tags
-			for _, t := range tagsSlice {
+			if !*movingTagsLast {
+				pushAdditionalTags(credentials, extraTagsSourceContainerPath, r, tagsSlice)
+			}
+		}
 
-				targetContainerPath := fmt.Sprintf("%v/%v:%v", r, *container, t)
+		if *movingTagsLast {
+			moveTagsAfterVerifying(credentials, repositoriesSlice, estafetteBuildVersionAsTag, func(r string) string {
+				if separateImages {
+					return getContainerPath(r, getRepositoryContainer(r), estafetteBuildVersionAsTag)
+				}
+				return extraTagsSourceContainerPath
+			}, tagsSlice)
+		}
 
-				// tag container with additional tag
-				log.Printf("Tagging container image %v\n", targetContainerPath)
-				tagArgs := []string{
-					"tag",
-					sourceContainerPath,
-					targetContainerPath,
+		pushExtraReferences(credentials, sourceContainerPath, extraReferencesSlice)
+		activeRollback = nil
+
+	case "placeholder":
+
+		// image: extensions/docker:stable
+		// action: placeholder
+		// container: docker
+		// repositories:
+		// - extensions
+		// tags:
+		// - stable
+
+		// build a minimal image, so references in deploy manifests can be pulled before the real image exists
+		placeholderDirectory, err := ioutil.TempDir("", "placeholder")
+		handleError(err)
+		defer os.RemoveAll(placeholderDirectory)
+		err = ioutil.WriteFile(filepath.Join(placeholderDirectory, "Dockerfile"), []byte(fmt.Sprintf("FROM %v\nCOPY placeholder /placeholder\nLABEL estafette.placeholder=true\n", *placeholderBase)), 0644)
+		handleError(err)
+		err = ioutil.WriteFile(filepath.Join(placeholderDirectory, "placeholder"), []byte("placeholder for an image that isn't built yet\n"), 0644)
+		handleError(err)
+
+		loginIfRequired(credentials, *placeholderBase)
+
+		// never replace a real image, including the build version tag of an image that has been pushed already
+		placeholderTags := append([]string{estafetteBuildVersionAsTag}, tagsSlice...)
+		var placeholderReferences []string
+		for _, r := range repositoriesSlice {
+			for _, t := range placeholderTags {
+				targetContainerPath := getContainerPath(r, getRepositoryContainer(r), t)
+				loginIfRequired(credentials, targetContainerPath)
+				placeholderReferences = append(placeholderReferences, targetContainerPath)
+			}
+		}
+		missingReferences, existingReferences, err := splitExistingReferences(placeholderReferences, lookupImageInRegistry)
+		handleError(err)
+		for _, r := range existingReferences {
+			logInfo("Skipping placeholder for %v, it already exists in the registry\n", r)
+			recordSkippedTag(r, "already exists in the registry")
+		}
+
+		if len(missingReferences) > 0 {
+			logInfo("Building placeholder image from %v...\n", *placeholderBase)
+			args := []string{
+				"build",
+			}
+			for _, r := range missingReferences {
+				args = append(args, "--tag", r)
+			}
+			args = append(args, placeholderDirectory)
+			runDockerCommand(args)
+
+			for _, r := range missingReferences {
+				logInfo("Pushing placeholder image %v\n", r)
+				runDockerCommand([]string{"push", r})
+				recordPushedImage(r, r[strings.LastIndex(r, ":")+1:])
+			}
+		}
+
+	case "exists":
+
+		// image: extensions/docker:stable
+		// action: exists
+		// container: docker
+		// repositories:
+		// - extensions
+		// tags:
+		// - stable
+
+		// checks the tags, or the build version tag if no tags are set, in every repository
+		existsTags := tagsSlice
+		if len(existsTags) == 0 {
+			existsTags = []string{estafetteBuildVersionAsTag}
+		}
+		for _, r := range repositoriesSlice {
+			for _, t := range existsTags {
+				targetContainerPath := getContainerPath(r, getRepositoryContainer(r), t)
+
+				loginIfRequired(credentials, targetContainerPath)
+
+				logInfo("Checking whether container image %v exists\n", targetContainerPath)
+				exists, err := lookupImageInRegistry(targetContainerPath)
+				handleError(err)
+				if !exists {
+					logInfo("Container image %v doesn't exist\n", targetContainerPath)
+					os.Exit(imageMissingExitCode)
 				}
-				runCommand("docker", tagArgs)
+				logInfo("Container image %v exists\n", targetContainerPath)
+			}
+		}
+
+	case "sign":
+
+		// image: extensions/docker:stable
+		// action: sign
+		// container: docker
+		// repositories:
+		// - extensions
+		// tags:
+		// - stable
+		// signingKey: /secrets/cosign.key
+
+		if (*signingKey == "") == !*signKeyless {
+			failValidation("Set either `signingKey:` or `signKeyless: true` to sign images")
+		}
+		if _, err := exec.LookPath("cosign"); err != nil {
+			failValidation("The cosign CLI was not found in PATH; run this extension in an image that has cosign installed: %v", err)
+		}
+
+		// sign the build version tag and all additional tags in every repository, and only fail after trying all of them
+		var failedReferences []string
+		for _, r := range repositoriesSlice {
+			for _, t := range append([]string{estafetteBuildVersionAsTag}, tagsSlice...) {
+				targetContainerPath := getContainerPath(r, getRepositoryContainer(r), t)
 
 				loginIfRequired(credentials, targetContainerPath)
 
-				log.Printf("Pushing container image %v\n", targetContainerPath)
-				pushArgs := []string{
-					"push",
-					targetContainerPath,
+				logInfo("Signing container image %v\n", targetContainerPath)
+				err := signImage(targetContainerPath)
+				if err != nil {
+					logWarn("Signing container image %v failed: %v\n", targetContainerPath, err)
+					failedReferences = append(failedReferences, targetContainerPath)
+					continue
 				}
-				runCommand("docker", pushArgs)
+				recordSignedImage(targetContainerPath)
 			}
 		}
+		if len(failedReferences) > 0 {
+			logFatal("Signing container images %v failed", strings.Join(failedReferences, ", "))
+		}
 
 	default:
-		log.Fatal("Set `command: <command>` on this step to build, push or tag")
+		failValidation("%v", getInvalidActionMessage(*action))
+	}
+
+	finishAction()
+}
+
+// finishAction logs and writes the output of the action and reports its success
+func finishAction() {
+	logOutputSummary()
+
+	if *outputFile != "" {
+		logInfo("Writing output to %v\n", *outputFile)
+		err := writeOutput(*outputFile)
+		handleError(err)
 	}
+
+	pushMetrics(true)
 }
 
-func validateRepositories(repositories string) {
-	if repositories == "" {
-		log.Fatal("Set `repositories:` to list at least one `- <repository>` (for example like `- extensions`)")
+func validateFreeDiskSpace(path string, minFreeDiskMB int) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	handleError(err)
+
+	freeDiskMB := stat.Bavail * uint64(stat.Bsize) / 1024 / 1024
+	if freeDiskMB < uint64(minFreeDiskMB) {
+		failValidation("Only %v MB of disk space is available for %v, while `minFreeDiskMB: %v` is required; free up disk space on the agent", freeDiskMB, path, minFreeDiskMB)
 	}
+	logInfo("%v MB of disk space is available for %v\n", freeDiskMB, path)
 }
 
-func getCredentialsForContainer(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) *contracts.ContainerRepositoryCredentialConfig {
-	if credentials != nil {
-		for _, credentials := range credentials {
-			containerImageSlice := strings.Split(containerImage, "/")
-			containerRepo := strings.Join(containerImageSlice[:len(containerImageSlice)-1], "/")
+// prefixRegistryHost prefixes the repository with the registry host, unless its first segment already is a host; like docker
+// does a first segment with a period or colon is a host
+func prefixRegistryHost(repository, registryHost string) string {
+	firstSegment := strings.Split(repository, "/")[0]
+	if strings.ContainsAny(firstSegment, ".:") {
+		return repository
+	}
+	return strings.TrimSuffix(registryHost, "/") + "/" + repository
+}
+
+func validateRepositories(repositoriesSlice []string) {
+	if len(repositoriesSlice) == 0 {
+		failValidation("Set `repositories:` to list at least one `- <repository>` (for example like `- extensions`)")
+	}
+}
+
+func validateAddHosts(addHosts string) {
+	if addHosts == "" {
+		return
+	}
+	for _, h := range strings.Split(addHosts, ",") {
+		if !isValidAddHost(h) {
+			failValidation("Set `addHosts:` entries as `- host:ip` or `- host:host-gateway` (for example like `- host.docker.internal:host-gateway`), not `%v`", h)
+		}
+	}
+}
+
+func isValidAddHost(addHost string) bool {
+	// split on the first colon only, ipv6 addresses contain colons themselves
+	hostAndIP := strings.SplitN(addHost, ":", 2)
+	if len(hostAndIP) != 2 || hostAndIP[0] == "" {
+		return false
+	}
+	return hostAndIP[1] == "host-gateway" || net.ParseIP(hostAndIP[1]) != nil
+}
+
+func validateLabels(labels string) {
+	for _, l := range splitLabels(labels) {
+		if !strings.Contains(l, "=") || strings.HasPrefix(l, "=") {
+			failValidation("Set `labels:` entries as `- key=value` (for example like `- 'description=\"foo,bar\"'`), not `%v`", l)
+		}
+	}
+}
+
+// splitLabels splits the comma separated labels; commas inside double quotes or preceded by a backslash are part of the
+// label, the quotes and backslashes themselves are removed, so `a=b,description="foo,bar"` results in `a=b` and `description=foo,bar`
+func splitLabels(labels string) []string {
+	var labelsSlice []string
+	var label strings.Builder
+	inQuotes := false
+	escaped := false
+	for _, r := range labels {
+		switch {
+		case escaped:
+			label.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ',' && !inQuotes:
+			if label.Len() > 0 {
+				labelsSlice = append(labelsSlice, label.String())
+			}
+			label.Reset()
+		default:
+			label.WriteRune(r)
+		}
+	}
+	if label.Len() > 0 {
+		labelsSlice = append(labelsSlice, label.String())
+	}
+	return labelsSlice
+}
 
-			if containerRepo == credentials.Repository {
-				return credentials
+// splitPatterns splits comma separated regexes; unlike splitLabels it keeps backslashes, which are part of the regex syntax, only
+// commas inside double quotes or preceded by a backslash are part of the pattern, so `^v\d+$,"^[a-f0-9]{7,12}$"` results in
+// `^v\d+$` and `^[a-f0-9]{7,12}$`
+func splitPatterns(patterns string) []string {
+	var patternsSlice []string
+	var pattern strings.Builder
+	inQuotes := false
+	runes := []rune(patterns)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && runes[i+1] == ',':
+			pattern.WriteRune(',')
+			i++
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ',' && !inQuotes:
+			if pattern.Len() > 0 {
+				patternsSlice = append(patternsSlice, pattern.String())
 			}
+			pattern.Reset()
+		default:
+			pattern.WriteRune(r)
 		}
 	}
+	if pattern.Len() > 0 {
+		patternsSlice = append(patternsSlice, pattern.String())
+	}
+	return patternsSlice
+}
 
-	return nil
+// parseLabelFile returns the key=value labels in the file, skipping blank lines and lines starting with #
+func parseLabelFile(content string) []string {
+	var labelsSlice []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		labelsSlice = append(labelsSlice, line)
+	}
+	return labelsSlice
 }
 
-func loginIfRequired(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) {
-	credential := getCredentialsForContainer(credentials, containerImage)
-	if credential != nil {
+// mergeLabels returns the labels from both, with the overriding labels taking precedence for the same key
+func mergeLabels(labels, overridingLabels []string) []string {
+	overridingKeys := map[string]bool{}
+	for _, l := range overridingLabels {
+		overridingKeys[strings.SplitN(l, "=", 2)[0]] = true
+	}
 
-		log.Printf("Logging in to repository %v for image %v\n", credential.Repository, containerImage)
-		loginArgs := []string{
-			"login",
-			"--username",
-			credential.Username,
-			"--password",
-			credential.Password,
+	var mergedLabels []string
+	for _, l := range labels {
+		if !overridingKeys[strings.SplitN(l, "=", 2)[0]] {
+			mergedLabels = append(mergedLabels, l)
 		}
+	}
+	return append(mergedLabels, overridingLabels...)
+}
 
-		repositorySlice := strings.Split(credential.Repository, "/")
-		if len(repositorySlice) > 1 {
-			server := repositorySlice[0]
-			loginArgs = append(loginArgs, server)
+func validateBuildContexts(buildContexts string) {
+	if buildContexts == "" {
+		return
+	}
+	for _, bc := range strings.Split(buildContexts, ",") {
+		if !isValidBuildContext(bc) {
+			failValidation("Set `buildContexts:` entries as `- name=path` or `- name=docker-image://ref`, not `%v`", bc)
 		}
+	}
+}
 
-		err := exec.Command("docker", loginArgs...).Run()
-		handleError(err)
+func isValidBuildContext(buildContext string) bool {
+	return regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*=.+$`).MatchString(buildContext)
+}
+
+// getBuildContextImage returns the image reference of a name=docker-image://ref build context, or an empty string for other contexts
+func getBuildContextImage(buildContext string) string {
+	nameAndSource := strings.SplitN(buildContext, "=", 2)
+	if len(nameAndSource) != 2 || !strings.HasPrefix(nameAndSource[1], "docker-image://") {
+		return ""
 	}
+	return strings.TrimPrefix(nameAndSource[1], "docker-image://")
 }
 
-func handleError(err error) {
+// readDockerfile returns the inline Dockerfile content if it's set, or reads the dockerfile from the path
+func readDockerfile(inlineDockerfile, dockerfile string) ([]byte, error) {
+	if inlineDockerfile != "" {
+		return []byte(inlineDockerfile), nil
+	}
+	return ioutil.ReadFile(inWorkingDirectory(fmt.Sprintf("%v/%v", *path, dockerfile)))
+}
+
+// getSyntaxDirective returns the value of the # syntax= parser directive, which is only recognized in the comments at the top of the Dockerfile
+func getSyntaxDirective(dockerfileContent string) string {
+	for _, line := range strings.Split(dockerfileContent, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		directive := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), "=", 2)
+		if len(directive) == 2 && strings.EqualFold(strings.TrimSpace(directive[0]), "syntax") {
+			return strings.TrimSpace(directive[1])
+		}
+	}
+	return ""
+}
+
+// isPinnedFrontend checks whether the frontend image has a digest or a full x.y.z version tag
+func isPinnedFrontend(frontend string) bool {
+	return strings.Contains(frontend, "@sha256:") || regexp.MustCompile(`:[0-9]+\.[0-9]+\.[0-9]+[^:/]*$`).MatchString(frontend)
+}
+
+// getDockerClientVersion returns the version of the docker cli; it runs without the global flags, since those depend on the version,
+// and ignores the error docker version returns if the daemon isn't reachable
+func getDockerClientVersion() string {
+	output, _ := exec.Command("docker", "version", "--format", "{{.Client.Version}}").Output()
+	return strings.TrimSpace(string(output))
+}
+
+// getDockerServerVersion returns the version of the docker daemon that runs the builds
+func getDockerServerVersion() string {
+	output, _ := dockerCommand("version", "--format", "{{.Server.Version}}").Output()
+	return strings.TrimSpace(string(output))
+}
+
+// getDockerServerArch returns the architecture of the docker daemon, in the same amd64 or arm64 form as GOARCH
+func getDockerServerArch() string {
+	output, _ := dockerCommand("version", "--format", "{{.Server.Arch}}").Output()
+	return strings.TrimSpace(string(output))
+}
+
+// suffixTagsWithArch appends the architecture to the build version tag and each of the tags
+func suffixTagsWithArch(buildVersionTag string, tags []string, arch string) (string, []string) {
+	if buildVersionTag != "" {
+		buildVersionTag = fmt.Sprintf("%v-%v", buildVersionTag, arch)
+	}
+	suffixedTags := make([]string, len(tags))
+	for i, t := range tags {
+		suffixedTags[i] = fmt.Sprintf("%v-%v", t, arch)
+	}
+	return buildVersionTag, suffixedTags
+}
+
+// isVersionAtLeast compares the major.minor.patch numbers of a docker version like 19.03.15 or 23.0.1-rc.1 with the minimum version
+func isVersionAtLeast(version, minimum string) bool {
+	parse := func(v string) []int {
+		var numbers []int
+		for _, p := range strings.SplitN(strings.SplitN(v, "-", 2)[0], ".", 3) {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				break
+			}
+			numbers = append(numbers, n)
+		}
+		for len(numbers) < 3 {
+			numbers = append(numbers, 0)
+		}
+		return numbers
+	}
+	if version == "" {
+		return false
+	}
+	versionNumbers, minimumNumbers := parse(version), parse(minimum)
+	for i := range minimumNumbers {
+		if versionNumbers[i] != minimumNumbers[i] {
+			return versionNumbers[i] > minimumNumbers[i]
+		}
+	}
+	return true
+}
+
+func buildkitEnabled() bool {
+	return os.Getenv("DOCKER_BUILDKIT") == "1"
+}
+
+// splitRepositories splits on commas and newlines, ignoring whitespace and empty entries
+func splitRepositories(repositories string) []string {
+	var repositoriesSlice []string
+	for _, r := range strings.FieldsFunc(repositories, func(c rune) bool { return c == ',' || c == '\n' }) {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			repositoriesSlice = append(repositoriesSlice, r)
+		}
+	}
+	return repositoriesSlice
+}
+
+// parseRepositoryDockerfiles parses repository=Dockerfile entries separated by semicolons, with an optional :container suffix to override the container name
+func parseRepositoryDockerfiles(repositoryDockerfiles string) (map[string]string, map[string]string, error) {
+	repositoryDockerfilesMap := map[string]string{}
+	repositoryContainersMap := map[string]string{}
+	for _, e := range strings.Split(repositoryDockerfiles, ";") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		repositoryAndDockerfile := strings.SplitN(e, "=", 2)
+		if len(repositoryAndDockerfile) != 2 || repositoryAndDockerfile[0] == "" || repositoryAndDockerfile[1] == "" {
+			return nil, nil, fmt.Errorf("Entry %v is not formatted as repository=Dockerfile or repository=Dockerfile:container", e)
+		}
+		dockerfileAndContainer := strings.SplitN(repositoryAndDockerfile[1], ":", 2)
+		if dockerfileAndContainer[0] == "" || (len(dockerfileAndContainer) == 2 && dockerfileAndContainer[1] == "") {
+			return nil, nil, fmt.Errorf("Entry %v is not formatted as repository=Dockerfile or repository=Dockerfile:container", e)
+		}
+		repositoryDockerfilesMap[repositoryAndDockerfile[0]] = dockerfileAndContainer[0]
+		if len(dockerfileAndContainer) == 2 {
+			repositoryContainersMap[repositoryAndDockerfile[0]] = dockerfileAndContainer[1]
+		}
+	}
+	return repositoryDockerfilesMap, repositoryContainersMap, nil
+}
+
+// repositoryContainers are the container names overridden per repository in repositoryDockerfiles
+var repositoryContainers = map[string]string{}
+
+// getRepositoryContainer returns the container name to use in references for the repository
+func getRepositoryContainer(repository string) string {
+	if c, ok := repositoryContainers[repository]; ok {
+		return c
+	}
+	return *container
+}
+
+// buildGroup is a dockerfile with the repositories the image built from it gets tagged for
+type buildGroup struct {
+	dockerfile   string
+	repositories []string
+}
+
+func groupRepositoriesByDockerfile(repositories []string, defaultDockerfile string, repositoryDockerfiles map[string]string) []buildGroup {
+	var buildGroups []buildGroup
+	for _, r := range repositories {
+		dockerfile, ok := repositoryDockerfiles[r]
+		if !ok {
+			dockerfile = defaultDockerfile
+		}
+
+		grouped := false
+		for i := range buildGroups {
+			if buildGroups[i].dockerfile == dockerfile {
+				buildGroups[i].repositories = append(buildGroups[i].repositories, r)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			buildGroups = append(buildGroups, buildGroup{dockerfile: dockerfile, repositories: []string{r}})
+		}
+	}
+	return buildGroups
+}
+
+func validateRepositoryTemplate(template string) {
+	if !strings.HasSuffix(template, ":{tag}") {
+		failValidation("Set `repositoryTemplate:` to a template ending in `:{tag}` (for example like `{repository}/myorg/{container}:{tag}`), not `%v`", template)
+	}
+}
+
+func validateReferenceStyle(style, namespace, template string) {
+	switch style {
+	case "docker":
+	case "namespaced":
+		if namespace == "" {
+			failValidation("Set `referenceNamespace:` when using `referenceStyle: namespaced`")
+		}
+		if template != "{repository}/{container}:{tag}" {
+			failValidation("Set either `referenceStyle: namespaced` or `repositoryTemplate:`, they can't be combined")
+		}
+	default:
+		failValidation("Set `referenceStyle:` to docker or namespaced, not `%v`", style)
+	}
+}
+
+// getReferenceTemplate returns the template all image references are rendered from for the reference style
+func getReferenceTemplate(style, namespace, template string) string {
+	if style == "namespaced" {
+		return "{repository}/" + strings.Trim(namespace, "/") + "/{container}:{tag}"
+	}
+	return template
+}
+
+func getContainerPath(repository, container, tag string) string {
+	return renderRepositoryTemplate(getReferenceTemplate(*referenceStyle, *referenceNamespace, *repositoryTemplate), repository, container, tag)
+}
+
+func getContainerRepository(repository, container string) string {
+	// the template is validated to end in :{tag}, so rendering it without tag leaves the repository with a trailing colon
+	return strings.TrimSuffix(getContainerPath(repository, container, ""), ":")
+}
+
+func renderRepositoryTemplate(template, repository, container, tag string) string {
+	return strings.NewReplacer("{repository}", repository, "{container}", container, "{tag}", tag).Replace(template)
+}
+
+func validateIsolation(isolation string) {
+	if isolation != "" && !contains([]string{"default", "process", "hyperv"}, isolation) {
+		failValidation("Set `isolation:` to default, process or hyperv, not `%v`", isolation)
+	}
+}
+
+func validateBuildResources(memory, cpus string) {
+	if memory != "" && !regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`).MatchString(memory) {
+		failValidation("Set `buildMemory:` to a number with an optional unit b, k, m or g (for example like `2g`), not `%v`", memory)
+	}
+	if cpus != "" {
+		if _, err := getCPUQuota(cpus); err != nil {
+			failValidation("Set `buildCpus:` to a positive number (for example like `1.5`), not `%v`", cpus)
+		}
+	}
+}
+
+const cpuPeriod = 100000
+
+func getCPUQuota(cpus string) (int, error) {
+	value, err := strconv.ParseFloat(cpus, 64)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
+	if value <= 0 {
+		return 0, fmt.Errorf("Number of cpus %v is not positive", cpus)
+	}
+	return int(value * cpuPeriod), nil
 }
 
-func runCommand(command string, args []string) {
-	log.Printf("Running command '%v %v'...", command, strings.Join(args, " "))
-	cmd := exec.Command(command, args...)
-	cmd.Dir = "/estafette-work"
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	handleError(err)
+func validateTagsDontExist(credentials []*contracts.ContainerRepositoryCredentialConfig, repositoriesSlice, tagsSlice []string) {
+	pushedImageIDs := readPushState(inWorkingDirectory(pushStateFile))
+	for _, r := range repositoriesSlice {
+		for _, t := range tagsSlice {
+			targetContainerPath := getContainerPath(r, getRepositoryContainer(r), t)
+
+			// a retry of the action finds the tags pushed by the previous attempt, those aren't overwritten by a different image
+			if _, ok := pushedImageIDs[targetContainerPath]; ok && pushedInPreviousAttempt(pushedImageIDs, targetContainerPath, getLocalImageID(targetContainerPath)) {
+				logInfo("Container image %v was pushed in a previous attempt, not checking whether it already exists\n", targetContainerPath)
+				continue
+			}
+
+			loginIfRequired(credentials, targetContainerPath)
+
+			logInfo("Checking whether container image %v already exists\n", targetContainerPath)
+			exists, err := lookupImageInRegistry(targetContainerPath)
+			handleError(err)
+			if exists {
+				failValidation("Container image %v already exists and `failIfTagExists: true` is set; tags in this repository can't be overwritten", targetContainerPath)
+			}
+		}
+	}
+}
+
+// imageExistsInRegistry checks whether the reference exists in the registry, counting a failed lookup as missing; callers log in
+// first, since they usually push to it as well
+func imageExistsInRegistry(containerImage string) bool {
+	exists, _ := lookupImageInRegistry(containerImage)
+	return exists
+}
+
+// lookupImageInRegistry checks whether the reference exists in the registry, returning an error if the registry can't tell, for
+// example for authentication, network or rate limit errors
+func lookupImageInRegistry(containerImage string) (bool, error) {
+	_, err := inspectRemoteManifest(nil, containerImage)
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if isManifestNotFound(string(exitErr.Stderr)) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Checking whether container image %v exists failed: %v", containerImage, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return false, fmt.Errorf("Checking whether container image %v exists failed: %v", containerImage, err)
+}
+
+// isManifestNotFound checks whether docker manifest inspect failed because the registry doesn't have the manifest or repository
+func isManifestNotFound(output string) bool {
+	output = strings.ToLower(output)
+	return strings.Contains(output, "no such manifest") || strings.Contains(output, "manifest unknown") || strings.Contains(output, "name unknown")
+}
+
+// inspectRemoteManifest logs in if required and returns the docker manifest inspect --verbose output for the image in the registry
+func inspectRemoteManifest(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) ([]byte, error) {
+	loginIfRequired(credentials, containerImage)
+	// docker manifest is still experimental in the docker cli
+	cmd := dockerCommand("manifest", "inspect", "--verbose", containerImage)
+	cmd.Env = append(os.Environ(), "DOCKER_CLI_EXPERIMENTAL=enabled")
+	return cmd.Output()
+}
+
+// getImageLabel returns the value of the label of the local image, or an empty string if it doesn't have the label
+func getImageLabel(containerImage, label string) string {
+	output, err := dockerCommand("image", "inspect", "--format", fmt.Sprintf("{{ index .Config.Labels %q }}", label), containerImage).Output()
+	handleError(err)
+	return parseInspectedLabel(string(output))
+}
+
+// parseInspectedLabel returns the label value from docker inspect output, which is <no value> for a missing label
+func parseInspectedLabel(output string) string {
+	value := strings.TrimSpace(output)
+	if value == "<no value>" {
+		return ""
+	}
+	return value
+}
+
+// splitExistingReferences returns the references that don't exist yet and the ones that do
+func splitExistingReferences(references []string, lookup func(reference string) (bool, error)) ([]string, []string, error) {
+	var missingReferences, existingReferences []string
+	for _, r := range references {
+		exists, err := lookup(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			existingReferences = append(existingReferences, r)
+		} else {
+			missingReferences = append(missingReferences, r)
+		}
+	}
+	return missingReferences, existingReferences, nil
+}
+
+// isBaseImageOutdated checks whether the local image id differs from the image config digests in the registry; an image that
+// isn't available locally is pulled by the build anyway, so it's never outdated
+func isBaseImageOutdated(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) bool {
+	if !imageExistsLocally(containerImage) {
+		return false
+	}
+	output, err := dockerCommand("image", "inspect", "--format", "{{.Id}}", containerImage).Output()
+	handleError(err)
+	localImageID := strings.TrimSpace(string(output))
+
+	logInfo("Comparing base image %v with the registry\n", containerImage)
+	output, err = inspectRemoteManifest(credentials, containerImage)
+	if err != nil {
+		logWarn("Can't inspect base image %v in the registry: %v\n", containerImage, err)
+		return false
+	}
+	remoteConfigDigests, err := getManifestConfigDigests(output)
+	handleError(err)
+
+	return !contains(remoteConfigDigests, localImageID)
+}
+
+// getBaseImageDigest resolves the manifest digest of the base image in the registry for the platform of this build
+func getBaseImageDigest(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) string {
+	output, err := inspectRemoteManifest(credentials, containerImage)
+	if err != nil {
+		logFatal("Can't inspect base image %v in the registry to pin its digest: %v", containerImage, err)
+	}
+	digest, err := getManifestDigest(output, runtime.GOOS, runtime.GOARCH)
+	handleError(err)
+	return digest
+}
+
+// getManifestDigest returns the manifest digest from docker manifest inspect --verbose output; for a multi platform image it's the
+// digest of the manifest for the os and architecture
+func getManifestDigest(manifestOutput []byte, goos, architecture string) (string, error) {
+	type verboseManifest struct {
+		Descriptor struct {
+			Digest   string
+			Platform struct {
+				Architecture string
+				OS           string
+			}
+		}
+	}
+
+	if !strings.HasPrefix(strings.TrimSpace(string(manifestOutput)), "[") {
+		var manifest verboseManifest
+		if err := json.Unmarshal(manifestOutput, &manifest); err != nil {
+			return "", err
+		}
+		if manifest.Descriptor.Digest == "" {
+			return "", fmt.Errorf("No manifest digest in docker manifest inspect output")
+		}
+		return manifest.Descriptor.Digest, nil
+	}
+
+	var manifests []verboseManifest
+	if err := json.Unmarshal(manifestOutput, &manifests); err != nil {
+		return "", err
+	}
+	for _, m := range manifests {
+		if m.Descriptor.Platform.OS == goos && m.Descriptor.Platform.Architecture == architecture {
+			return m.Descriptor.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("No manifest for platform %v/%v in docker manifest inspect output", goos, architecture)
+}
+
+// pinBaseImageDigests rewrites the FROM instructions for the images to reference them by digest
+func pinBaseImageDigests(dockerfileContent string, digests map[string]string) string {
+	lines := strings.Split(dockerfileContent, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		for j, f := range fields[1:] {
+			if strings.HasPrefix(f, "--") {
+				continue
+			}
+			if digest, ok := digests[f]; ok {
+				fields[j+1] = fmt.Sprintf("%v@%v", f, digest)
+				lines[i] = strings.Join(fields, " ")
+			}
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// getManifestConfigDigests returns the image config digests from docker manifest inspect --verbose output, which is a single
+// manifest for a single platform image and an array of manifests for a multi platform image; the config digest equals the local image id
+func getManifestConfigDigests(manifestOutput []byte) ([]string, error) {
+	type verboseManifest struct {
+		SchemaV2Manifest struct {
+			Config struct {
+				Digest string
+			}
+		}
+	}
+
+	var manifests []verboseManifest
+	if strings.HasPrefix(strings.TrimSpace(string(manifestOutput)), "[") {
+		if err := json.Unmarshal(manifestOutput, &manifests); err != nil {
+			return nil, err
+		}
+	} else {
+		var manifest verboseManifest
+		if err := json.Unmarshal(manifestOutput, &manifest); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	var configDigests []string
+	for _, m := range manifests {
+		if m.SchemaV2Manifest.Config.Digest != "" {
+			configDigests = append(configDigests, m.SchemaV2Manifest.Config.Digest)
+		}
+	}
+	return configDigests, nil
+}
+
+// getBaseImages does a best-effort parse of the FROM instructions in a Dockerfile, skipping scratch, earlier build stages and
+// images with build arguments that can't be resolved without building
+func getBaseImages(dockerfileContent string) []string {
+	var baseImages []string
+	var stages []string
+	for _, line := range strings.Split(dockerfileContent, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// skip flags like --platform
+		var imageAndStage []string
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "--") {
+				imageAndStage = append(imageAndStage, f)
+			}
+		}
+		if len(imageAndStage) == 0 {
+			continue
+		}
+		image := imageAndStage[0]
+
+		if image != "scratch" && !strings.Contains(image, "$") && !contains(stages, strings.ToLower(image)) && !contains(baseImages, image) {
+			baseImages = append(baseImages, image)
+		}
+		if len(imageAndStage) == 3 && strings.EqualFold(imageAndStage[1], "AS") {
+			stages = append(stages, strings.ToLower(imageAndStage[2]))
+		}
+	}
+	return baseImages
+}
+
+// pushDebugImage builds the debug stage of a failed build and pushes it under the debug tag; failures are only logged, since the
+// step fails for the failed build anyway
+func pushDebugImage(credentials []*contracts.ContainerRepositoryCredentialConfig, b groupBuild, buildLog io.Writer) {
+	var debugReferences []string
+	for _, r := range b.repositories {
+		debugReferences = append(debugReferences, getContainerPath(r, getRepositoryContainer(r), *debugTag))
+	}
+
+	logInfo("Building debug stage %v of %v for debugging the failed build\n", *pushDebugOnFailure, b.dockerfile)
+	debugBuild := b
+	debugBuild.args = getDebugBuildArgs(b.args, *pushDebugOnFailure, debugReferences)
+	if err := runBuild(debugBuild, teeOutput(os.Stdout, buildLog), teeOutput(os.Stderr, buildLog)); err != nil {
+		logWarn("Building debug stage %v of %v failed: %v\n", *pushDebugOnFailure, b.dockerfile, err)
+		return
+	}
+
+	for _, r := range debugReferences {
+		loginIfRequired(credentials, r)
+		logInfo("Pushing debug image %v\n", r)
+		if err := dockerCommand("push", r).Run(); err != nil {
+			logWarn("Pushing debug image %v failed: %v\n", r, err)
+			continue
+		}
+		recordPushedImage(r, *debugTag)
+	}
+}
+
+// wrapImageEntrypoint builds a derived image from a generated Dockerfile that copies in the wrapper and makes it the entrypoint, and
+// retags it with the tags of the built image, so the build's own Dockerfile doesn't have to change
+func wrapImageEntrypoint(containerImage string, tags []string) {
+	logInfo("Wrapping entrypoint of container image %v with %v\n", containerImage, *wrapEntrypoint)
+
+	var entrypoint, cmd []string
+	output, err := dockerCommand("image", "inspect", "--format", "{{json .Config.Entrypoint}}", containerImage).Output()
+	handleError(err)
+	handleError(json.Unmarshal(output, &entrypoint))
+	output, err = dockerCommand("image", "inspect", "--format", "{{json .Config.Cmd}}", containerImage).Output()
+	handleError(err)
+	handleError(json.Unmarshal(output, &cmd))
+
+	wrapperDirectory, err := ioutil.TempDir("", "wrapper")
+	handleError(err)
+	defer os.RemoveAll(wrapperDirectory)
+	err = copyPath(inWorkingDirectory(*wrapEntrypoint), filepath.Join(wrapperDirectory, "wrapper"), true)
+	handleError(err)
+	err = ioutil.WriteFile(filepath.Join(wrapperDirectory, "Dockerfile"), []byte(getWrapperDockerfile(containerImage, entrypoint, cmd)), 0644)
+	handleError(err)
+
+	args := []string{"build"}
+	for _, t := range tags {
+		args = append(args, "--tag", t)
+	}
+	args = append(args, wrapperDirectory)
+	runDockerCommand(args)
+}
+
+const wrapperPath = "/estafette-entrypoint-wrapper"
+
+// getWrapperDockerfile returns a Dockerfile that puts the wrapper in front of the original entrypoint; setting ENTRYPOINT clears
+// the inherited CMD, so that is set again as well
+func getWrapperDockerfile(containerImage string, entrypoint, cmd []string) string {
+	entrypointJSON, _ := json.Marshal(append([]string{wrapperPath}, entrypoint...))
+
+	dockerfile := fmt.Sprintf("FROM %v\nCOPY wrapper %v\nENTRYPOINT %v\n", containerImage, wrapperPath, string(entrypointJSON))
+	if len(cmd) > 0 {
+		cmdJSON, _ := json.Marshal(cmd)
+		dockerfile += fmt.Sprintf("CMD %v\n", string(cmdJSON))
+	}
+	return dockerfile
+}
+
+func appendDigestTag(tagsSlice []string, containerImage string) []string {
+	output, err := dockerCommand("image", "inspect", "--format", "{{.Id}}", containerImage).Output()
+	handleError(err)
+
+	digestTagValue := getDigestTag(strings.TrimSpace(string(output)))
+	logInfo("Adding tag %v for image id %v\n", digestTagValue, strings.TrimSpace(string(output)))
+	if contains(tagsSlice, digestTagValue) {
+		return tagsSlice
+	}
+	return append(tagsSlice, digestTagValue)
+}
+
+// getDigestTag returns sha-<first 12 characters of the digest>, like the short image ids shown by docker
+func getDigestTag(imageID string) string {
+	digest := strings.TrimPrefix(imageID, "sha256:")
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return "sha-" + digest
+}
+
+func pullSourceImage(credentials []*contracts.ContainerRepositoryCredentialConfig, sourceContainerPath string) {
+	policy := getSourcePullPolicy(*sourcePullPolicy, *pullSource)
+	if policy == "if-not-present" && imageExistsLocally(sourceContainerPath) {
+		logInfo("Skipping pull, container image %v exists locally\n", sourceContainerPath)
+		return
+	}
+
+	if policy != "never" {
+		loginIfRequired(credentials, sourceContainerPath)
+
+		logInfo("Pulling container image %v\n", sourceContainerPath)
+		pullArgs := []string{
+			"pull",
+			sourceContainerPath,
+		}
+		runDockerCommand(pullArgs)
+	} else {
+		// tag from the local image, which has to be built on this same agent
+		logInfo("Skipping pull, using local container image %v\n", sourceContainerPath)
+		if !imageExistsLocally(sourceContainerPath) {
+			failValidation("Container image %v doesn't exist locally; set `sourcePullPolicy:` to always or if-not-present to pull it first", sourceContainerPath)
+		}
+	}
+}
+
+// getSourcePullPolicy returns the pull policy, which defaults to always or never depending on the older pullSource flag
+func getSourcePullPolicy(policy string, pullSource bool) string {
+	if policy != "" {
+		return policy
+	}
+	if pullSource {
+		return "always"
+	}
+	return "never"
+}
+
+func validateSourceImageID(sourceImageID string) {
+	if !regexp.MustCompile(`^(sha256:)?[a-f0-9]{12,64}$`).MatchString(sourceImageID) {
+		failValidation("Set `sourceImageId:` to a local image id (for example like `sha256:4b1f7e6b...`), not `%v`", sourceImageID)
+	}
+	if !imageExistsLocally(sourceImageID) {
+		failValidation("Image %v set in `sourceImageId:` doesn't exist locally", sourceImageID)
+	}
+}
+
+func pruneDanglingImages() {
+	// without -a only dangling images are removed, so the layers of tagged images stay available as cache
+	logInfo("Pruning dangling images\n")
+	output, err := dockerCommand("image", "prune", "-f").CombinedOutput()
+	if err != nil {
+		logWarn("Pruning dangling images failed: %v\n%v", err, string(output))
+		return
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "Total reclaimed space") {
+			logInfo("%v", line)
+		}
+	}
+}
+
+func imageExistsLocally(containerImage string) bool {
+	err := dockerCommand("image", "inspect", containerImage).Run()
+	return err == nil
+}
+
+// getLocalImageID returns the id of the local image, or an empty string if the image doesn't exist locally
+func getLocalImageID(containerImage string) string {
+	output, err := dockerCommand("image", "inspect", "--format", "{{.Id}}", containerImage).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func validateDockerConfig(dockerConfigPath string) {
+	if _, err := os.Stat(dockerConfigPath); err != nil {
+		failValidation("Set `useDockerConfig: true` only when a docker config is mounted at %v: %v", dockerConfigPath, err)
+	}
+}
+
+func addDockerConfigJSONAuths(encodedDockerConfigJSON, dockerConfigPath string) error {
+	auths, err := decodeDockerConfigJSONAuths(encodedDockerConfigJSON)
+	if err != nil {
+		return err
+	}
+
+	// keep any existing config and auths, the secret's auths take precedence
+	dockerConfig := map[string]interface{}{}
+	if existingDockerConfig, err := ioutil.ReadFile(dockerConfigPath); err == nil {
+		err = json.Unmarshal(existingDockerConfig, &dockerConfig)
+		if err != nil {
+			return fmt.Errorf("Existing docker config %v is not valid json: %v", dockerConfigPath, err)
+		}
+	}
+	existingAuths, ok := dockerConfig["auths"].(map[string]interface{})
+	if !ok {
+		existingAuths = map[string]interface{}{}
+	}
+	for registry, auth := range auths {
+		existingAuths[registry] = auth
+	}
+	dockerConfig["auths"] = existingAuths
+
+	data, err := json.MarshalIndent(dockerConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dockerConfigPath), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dockerConfigPath, data, 0600)
+}
+
+func decodeDockerConfigJSONAuths(encodedDockerConfigJSON string) (map[string]interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedDockerConfigJSON))
+	if err != nil {
+		return nil, fmt.Errorf("Value of dockerConfigJSON is not valid base64: %v", err)
+	}
+
+	var dockerConfig struct {
+		Auths map[string]interface{} `json:"auths"`
+	}
+	err = json.Unmarshal(data, &dockerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Value of dockerConfigJSON is not a valid .dockerconfigjson: %v", err)
+	}
+	if len(dockerConfig.Auths) == 0 {
+		return nil, fmt.Errorf("Value of dockerConfigJSON has no auths")
+	}
+
+	return dockerConfig.Auths, nil
+}
+
+func getDockerConfigPath() string {
+	// the docker cli reads its config from --config if set, from $DOCKER_CONFIG if set or from ~/.docker otherwise
+	if *dockerConfigDir != "" {
+		return filepath.Join(*dockerConfigDir, "config.json")
+	}
+	if os.Getenv("DOCKER_CONFIG") != "" {
+		return filepath.Join(os.Getenv("DOCKER_CONFIG"), "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// environmentCredential is a repository credential that can be restricted to an environment
+type environmentCredential struct {
+	contracts.ContainerRepositoryCredentialConfig
+	Environment string
+}
+
+// unmarshalCredentials drops credentials for other environments than the given one and orders the ones for the environment
+// first, so they're preferred over credentials without environment for the same repository
+func unmarshalCredentials(data []byte, environment string) ([]*contracts.ContainerRepositoryCredentialConfig, error) {
+	var environmentCredentials []environmentCredential
+	err := json.Unmarshal(data, &environmentCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching, untagged []*contracts.ContainerRepositoryCredentialConfig
+	for i := range environmentCredentials {
+		c := environmentCredentials[i]
+		switch c.Environment {
+		case "":
+			untagged = append(untagged, &c.ContainerRepositoryCredentialConfig)
+		case environment:
+			matching = append(matching, &c.ContainerRepositoryCredentialConfig)
+		}
+	}
+
+	return append(matching, untagged...), nil
+}
+
+// mergeCredentials combines both credential lists; for a repository present in both the overrides win
+func mergeCredentials(credentials, overrides []*contracts.ContainerRepositoryCredentialConfig) []*contracts.ContainerRepositoryCredentialConfig {
+	merged := []*contracts.ContainerRepositoryCredentialConfig{}
+	for _, c := range credentials {
+		overridden := false
+		for _, o := range overrides {
+			if o.Repository == c.Repository {
+				overridden = true
+				break
+			}
+		}
+		if overridden {
+			logInfo("Using credentials for repository %v from credentialsFile\n", c.Repository)
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return append(merged, overrides...)
+}
+
+// getCredentialsForContainer returns the credentials for the repository the reference is rendered from; with a repositoryTemplate or
+// the namespaced reference style more path segments follow the repository, so the credentials with the longest repository the
+// reference starts with are used if none matches the path without its last segment exactly
+func getCredentialsForContainer(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) *contracts.ContainerRepositoryCredentialConfig {
+	containerImageSlice := strings.Split(containerImage, "/")
+	containerRepo := strings.Join(containerImageSlice[:len(containerImageSlice)-1], "/")
+
+	var credential *contracts.ContainerRepositoryCredentialConfig
+	for _, c := range credentials {
+		if containerRepo == c.Repository {
+			credential = c
+			break
+		}
+		if strings.HasPrefix(containerImage, c.Repository+"/") && (credential == nil || len(c.Repository) > len(credential.Repository)) {
+			credential = c
+		}
+	}
+	if credential == nil {
+		return nil
+	}
+
+	if *credentialScope != "" && !isRepositoryInScope(credential.Repository, strings.Split(*credentialScope, ",")) {
+		logWarn("Not using credentials for repository %v, it's outside of credentialScope\n", credential.Repository)
+		return nil
+	}
+	return credential
+}
+
+// isRepositoryInScope checks whether the repository equals or is nested in one of the scopes
+func isRepositoryInScope(repository string, scopes []string) bool {
+	for _, s := range scopes {
+		s = strings.TrimSuffix(s, "/")
+		if repository == s || strings.HasPrefix(repository, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidReferenceWithTag checks whether the reference has a tag after its last path segment and no digest
+func isValidReferenceWithTag(reference string) bool {
+	lastSegment := reference[strings.LastIndex(reference, "/")+1:]
+	return !strings.Contains(reference, "@") && regexp.MustCompile(`^[a-z0-9._\-]+:[a-zA-Z0-9_][a-zA-Z0-9_.\-]{0,127}$`).MatchString(lastSegment)
+}
+
+// pushAdditionalTags tags the source image with each tag in the repository and pushes it
+func pushAdditionalTags(credentials []*contracts.ContainerRepositoryCredentialConfig, sourceContainerPath, repository string, tags []string) {
+	for _, t := range tags {
+
+		targetContainerPath := getContainerPath(repository, getRepositoryContainer(repository), t)
+
+		// tag container with additional tag
+		logInfo("Tagging container image %v\n", targetContainerPath)
+		tagArgs := []string{
+			"tag",
+			sourceContainerPath,
+			targetContainerPath,
+		}
+		runDockerCommand(tagArgs)
+
+		loginIfRequired(credentials, targetContainerPath)
+
+		pushContainerImage(targetContainerPath, t)
+	}
+}
+
+// moveTagsAfterVerifying checks that the build version tag exists in every repository before pushing the additional tags to any of
+// them, so a failure halfway doesn't leave latest in one repository pointing to an image missing from another; registries are
+// independent, so a failure while moving the tags can still leave them inconsistent
+func moveTagsAfterVerifying(credentials []*contracts.ContainerRepositoryCredentialConfig, repositories []string, buildVersionTag string, getSource func(repository string) string, tags []string) {
+	// without tags to move there's nothing to verify, and with digestOnly and deleteVersionTag the build version tag is gone already
+	if len(tags) == 0 {
+		return
+	}
+
+	for _, r := range repositories {
+		targetContainerPath := getContainerPath(r, getRepositoryContainer(r), buildVersionTag)
+		loginIfRequired(credentials, targetContainerPath)
+		if !imageExistsInRegistry(targetContainerPath) {
+			logFatal("Container image %v doesn't exist in the registry after pushing it, not moving tags %v", targetContainerPath, strings.Join(tags, ", "))
+		}
+		logInfo("Verified container image %v exists\n", targetContainerPath)
+	}
+
+	for _, r := range repositories {
+		pushAdditionalTags(credentials, getSource(r), r, tags)
+	}
+}
+
+// pushExtraReferences tags and pushes the source image to each of the complete references
+func pushExtraReferences(credentials []*contracts.ContainerRepositoryCredentialConfig, sourceContainerPath string, references []string) {
+	for _, r := range references {
+		logInfo("Tagging container image %v\n", r)
+		runDockerCommand([]string{"tag", sourceContainerPath, r})
+
+		loginForReference(credentials, r)
+
+		pushContainerImage(r, r[strings.LastIndex(r, ":")+1:])
+	}
+}
+
+// loginForReference logs in for a complete reference from input, which often doesn't match a credential's repository exactly,
+// so it falls back to the credentials for the registry host
+func loginForReference(credentials []*contracts.ContainerRepositoryCredentialConfig, reference string) {
+	if credential := getCredentialsForReference(credentials, reference); credential != nil {
+		login(credential, reference)
+	}
+}
+
+// getCredentialsForReference returns the credentials for the repository of the reference, or else for its registry host
+func getCredentialsForReference(credentials []*contracts.ContainerRepositoryCredentialConfig, reference string) *contracts.ContainerRepositoryCredentialConfig {
+	credential := getCredentialsForContainer(credentials, reference)
+	if credential == nil {
+		credential = getCredentialsForHost(credentials, reference)
+	}
+	return credential
+}
+
+// getCredentialsForHost returns the first credentials for a repository on the same registry host as the image
+func getCredentialsForHost(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) *contracts.ContainerRepositoryCredentialConfig {
+	host := strings.Split(containerImage, "/")[0]
+	for _, c := range credentials {
+		if strings.Split(c.Repository, "/")[0] == host {
+			if *credentialScope != "" && !isRepositoryInScope(c.Repository, strings.Split(*credentialScope, ",")) {
+				continue
+			}
+			return c
+		}
+	}
+	return nil
+}
+
+func loginIfRequired(credentials []*contracts.ContainerRepositoryCredentialConfig, containerImage string) {
+	credential := getCredentialsForContainer(credentials, containerImage)
+	if credential == nil {
+		if len(credentials) > 0 {
+			logInfo("No credentials found for image %v, not logging in\n", containerImage)
+		}
+		return
+	}
+	login(credential, containerImage)
+}
+
+func login(credential *contracts.ContainerRepositoryCredentialConfig, containerImage string) {
+	logInfo("Logging in to repository %v for image %v\n", credential.Repository, containerImage)
+	loginArgs := []string{
+		"login",
+		"--username",
+		credential.Username,
+		"--password",
+		credential.Password,
+	}
+
+	// docker login defaults to docker hub without a server
+	server := "docker.io"
+	repositorySlice := strings.Split(credential.Repository, "/")
+	if len(repositorySlice) > 1 {
+		server = repositorySlice[0]
+		loginArgs = append(loginArgs, server)
+	}
+
+	for attempt := 0; ; attempt++ {
+		output, err := dockerCommand(loginArgs...).CombinedOutput()
+		if err == nil {
+			break
+		}
+		if isLoginAuthFailure(string(output)) {
+			logFatal("Logging in to repository %v failed, check its credentials: %v", credential.Repository, strings.TrimSpace(string(output)))
+		}
+		if attempt >= *loginRetries {
+			logFatal("Logging in to repository %v failed: %v: %v", credential.Repository, err, strings.TrimSpace(string(output)))
+		}
+		backoff := time.Duration(1<<uint(attempt)) * time.Second
+		logWarn("Logging in to repository %v failed, retrying in %v: %v\n", credential.Repository, backoff, strings.TrimSpace(string(output)))
+		time.Sleep(backoff)
+	}
+	recordLogin(credential.Repository, server, credential.Username)
+}
+
+// isLoginAuthFailure checks the docker login output for rejected credentials, which fail the same way on every retry
+func isLoginAuthFailure(output string) bool {
+	output = strings.ToLower(output)
+	for _, m := range []string{"unauthorized", "authentication required", "incorrect username or password", "invalid username/password", "access denied"} {
+		if strings.Contains(output, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// validActions are the actions handled in main, for the validation message of unknown actions
+var validActions = []string{"build", "push", "tag", "build-and-push", "exists", "placeholder", "sign"}
+
+// getInvalidActionMessage returns the validation message for an action that isn't set or isn't one of the valid actions
+func getInvalidActionMessage(action string) string {
+	if action == "" {
+		return fmt.Sprintf("No action set; set `action: <action>` on this step to one of %v", strings.Join(validActions, ", "))
+	}
+	return fmt.Sprintf("Unknown action '%v'; valid actions are %v", action, strings.Join(validActions, ", "))
+}
+
+// validationErrorExitCode is used for invalid inputs, which are never retried by actionRetries
+const validationErrorExitCode = 2
+
+func failValidation(format string, v ...interface{}) {
+	message := redact(fmt.Sprintf(format, v...))
+	log.Print(message)
+	if *ciAnnotations != "" {
+		fmt.Println(formatCIAnnotation(*ciAnnotations, message))
+	}
+	pushMetrics(false)
+	os.Exit(validationErrorExitCode)
+}
+
+// imageMissingExitCode is used by the exists action when the registry reports an image as missing, to tell it apart from failures
+// to reach or authenticate with the registry
+const imageMissingExitCode = 3
+
+const retryAttemptEnvar = "ESTAFETTE_EXTENSION_RETRY_ATTEMPT"
+
+// runActionWithRetries re-executes this extension until the action succeeds; because the whole action is retried, steps
+// that already succeeded in a failed attempt run again, for example tags that were pushed before the failure are pushed again
+func runActionWithRetries(retries int) int {
+	for attempt := 1; ; attempt++ {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", retryAttemptEnvar, attempt))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err == nil {
+			return 0
+		}
+
+		exitCode := 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				exitCode = status.ExitStatus()
+			}
+		}
+
+		if exitCode == validationErrorExitCode {
+			logInfo("Action failed on invalid input, not retrying\n")
+			return exitCode
+		}
+		if exitCode == imageMissingExitCode {
+			return exitCode
+		}
+		if attempt > retries {
+			logInfo("Action failed after %v attempts\n", attempt)
+			return exitCode
+		}
+
+		backoff := time.Duration(attempt) * 5 * time.Second
+		logInfo("Action failed with exit code %v, retrying in %v (retry %v of %v)\n", exitCode, backoff, attempt, retries)
+		time.Sleep(backoff)
+	}
+}
+
+func handleError(err error) {
+	if err != nil {
+		logFatal("%v", err)
+	}
+}
+
+const workingDirectory = "/estafette-work"
+
+// inWorkingDirectory resolves relative paths the same way as commands run by runCommand
+func inWorkingDirectory(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workingDirectory, path)
+}
+
+// getProxyVariables returns name=value for the upper and lower case proxy variables, since tools differ in which one they read
+func getProxyVariables(httpProxy, httpsProxy, noProxy string) []string {
+	var proxyVariables []string
+	for _, p := range []struct{ name, value string }{{"HTTP_PROXY", httpProxy}, {"HTTPS_PROXY", httpsProxy}, {"NO_PROXY", noProxy}} {
+		if p.value != "" {
+			proxyVariables = append(proxyVariables, fmt.Sprintf("%v=%v", p.name, p.value), fmt.Sprintf("%v=%v", strings.ToLower(p.name), p.value))
+		}
+	}
+	return proxyVariables
+}
+
+// signImage signs the image with cosign, which uses the same docker config for registry authentication as docker itself
+func signImage(containerImage string) error {
+	cmd := exec.Command("cosign", getCosignSignArgs(*signingKey, containerImage)...)
+	cmd.Dir = workingDirectory
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if *dockerConfigDir != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("DOCKER_CONFIG=%v", *dockerConfigDir))
+	}
+	if *signingKey == "" {
+		// keyless signing is experimental in older cosign versions
+		cmd.Env = append(cmd.Env, "COSIGN_EXPERIMENTAL=1")
+	}
+	return cmd.Run()
+}
+
+// getCosignSignArgs returns the arguments to sign with the key, or keyless if the key is empty
+func getCosignSignArgs(key, containerImage string) []string {
+	args := []string{"sign"}
+	if key != "" {
+		args = append(args, "--key", key)
+	}
+	return append(args, "--yes", containerImage)
+}
+
+// pushContainerImage pushes the image and records it in the push state file, so a retried run can skip it; it's only skipped if
+// the reference still points to the same local image and the registry still has it
+func pushContainerImage(containerImage, tag string) {
+	statePath := inWorkingDirectory(pushStateFile)
+	output, err := dockerCommand("image", "inspect", "--format", "{{.Id}}", containerImage).Output()
+	handleError(err)
+	imageID := strings.TrimSpace(string(output))
+
+	if !*forceRepush && readPushState(statePath)[containerImage] == imageID && imageExistsInRegistry(containerImage) {
+		logInfo("Skipping push of container image %v, it was pushed in a previous attempt\n", containerImage)
+		recordPushedImage(containerImage, tag)
+		return
+	}
+
+	if activeRollback != nil {
+		activeRollback.recordPreviousManifest(containerImage)
+	}
+
+	logInfo("Pushing container image %v\n", containerImage)
+	runDockerCommand([]string{"push", containerImage})
+	recordPushedImage(containerImage, tag)
+
+	err = appendPushState(statePath, containerImage, imageID)
+	if err != nil {
+		logWarn("Recording push of container image %v in %v failed: %v\n", containerImage, statePath, err)
+	}
+}
+
+func runDockerCommand(args []string) {
+	runCommand("docker", withDockerGlobalFlags(args))
+}
+
+func runDockerCommandWithInput(args []string, input io.Reader) {
+	runCommandWithInput("docker", withDockerGlobalFlags(args), input)
+}
+
+func dockerCommand(args ...string) *exec.Cmd {
+	return exec.Command("docker", withDockerGlobalFlags(args)...)
+}
+
+func withDockerGlobalFlags(args []string) []string {
+	var globalFlags []string
+	if *dockerConfigDir != "" {
+		globalFlags = append(globalFlags, "--config", *dockerConfigDir)
+	}
+	if *dockerContext != "" {
+		globalFlags = append(globalFlags, "--context", *dockerContext)
+	}
+	return append(globalFlags, args...)
+}
+
+func runCommand(command string, args []string) {
+	runCommandWithInput(command, args, nil)
+}
+
+func runCommandWithInput(command string, args []string, input io.Reader) {
+	logDebug("Running command '%v %v'...", command, strings.Join(args, " "))
+	cmd := exec.Command(command, args...)
+	cmd.Dir = workingDirectory
+	cmd.Stdin = input
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	handleError(err)
+}
+
+func getRepoDigest(containerImage, repository string) string {
+	logInfo("Inspecting repo digests for container image %v\n", containerImage)
+	output, err := dockerCommand("inspect", "--format", "{{json .RepoDigests}}", containerImage).Output()
+	handleError(err)
+
+	var repoDigests []string
+	err = json.Unmarshal(output, &repoDigests)
+	handleError(err)
+
+	repoDigest := selectRepoDigest(repoDigests, repository)
+	if repoDigest == "" {
+		logFatal("No repo digest found for %v in %v", repository, strings.Join(repoDigests, ", "))
+	}
+
+	return repoDigest
+}
+
+func selectRepoDigest(repoDigests []string, repository string) string {
+	// an image pushed to multiple repositories has a repo digest per repository, pick the one for this repository
+	for _, d := range repoDigests {
+		if i := strings.Index(d, "@"); i >= 0 && getFamiliarRepository(d[:i]) == getFamiliarRepository(repository) {
+			return d
+		}
+	}
+	return ""
+}
+
+// getFamiliarRepository returns the repository in the short form docker uses for Docker Hub, so docker.io/library/alpine is alpine
+func getFamiliarRepository(repository string) string {
+	for _, prefix := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		repository = strings.TrimPrefix(repository, prefix)
+	}
+	return strings.TrimPrefix(repository, "library/")
+}
+
+// isEncryptedSecret checks whether the value is an Estafette secret that the CI didn't decrypt
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, "estafette.secret(") && strings.HasSuffix(value, ")")
+}
+
+// getCiBuildArgs returns name=value for the common ci variables, except for the excluded names
+func getCiBuildArgs(buildVersion, revision, branch string, exclude []string) []string {
+	var buildArgs []string
+	for _, a := range []struct{ name, value string }{{"CI", "true"}, {"BUILD_VERSION", buildVersion}, {"GIT_REVISION", revision}, {"GIT_BRANCH", branch}} {
+		if !contains(exclude, a.name) {
+			buildArgs = append(buildArgs, fmt.Sprintf("%v=%v", a.name, a.value))
+		}
+	}
+	return buildArgs
+}
+
+// getRequiredBuildArgs returns the ARG declarations without default before the first FROM in the Dockerfile, which are in scope
+// for every FROM; lines continued with a backslash aren't handled
+func getRequiredBuildArgs(dockerfileContent string) []string {
+	var requiredArgs []string
+	for _, line := range strings.Split(dockerfileContent, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "FROM") {
+			break
+		}
+		if !strings.EqualFold(fields[0], "ARG") {
+			continue
+		}
+		for _, a := range fields[1:] {
+			if !strings.Contains(a, "=") {
+				requiredArgs = append(requiredArgs, a)
+			}
+		}
+	}
+	return requiredArgs
+}
+
+// getMissingBuildArgs returns the required args that aren't passed with --build-arg in the docker build arguments
+func getMissingBuildArgs(requiredArgs, buildArguments []string) []string {
+	var passedArgs []string
+	for i, a := range buildArguments {
+		switch {
+		case a == "--build-arg" && i+1 < len(buildArguments):
+			passedArgs = append(passedArgs, strings.SplitN(buildArguments[i+1], "=", 2)[0])
+		case strings.HasPrefix(a, "--build-arg="):
+			passedArgs = append(passedArgs, strings.SplitN(strings.TrimPrefix(a, "--build-arg="), "=", 2)[0])
+		}
+	}
+
+	var missingArgs []string
+	for _, a := range requiredArgs {
+		if !contains(passedArgs, a) {
+			missingArgs = append(missingArgs, a)
+		}
+	}
+	return missingArgs
+}
+
+// getPrefixedBuildArgs returns name=value for each environment variable starting with the prefix, with the prefix stripped from the name
+func getPrefixedBuildArgs(environ []string, prefix string) []string {
+	var buildArgs []string
+	for _, e := range environ {
+		if strings.HasPrefix(e, prefix) && !strings.HasPrefix(e, prefix+"=") {
+			buildArgs = append(buildArgs, strings.TrimPrefix(e, prefix))
+		}
+	}
+	sort.Strings(buildArgs)
+	return buildArgs
+}
+
+// splitArguments splits a string into arguments on whitespace like a shell does, keeping whitespace inside single or
+// double quotes and after a backslash; the quotes and backslashes themselves are removed
+func splitArguments(value string) ([]string, error) {
+	var arguments []string
+	var argument strings.Builder
+	inArgument := false
+	var quote rune
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			argument.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArgument = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				argument.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArgument = true
+		case unicode.IsSpace(r):
+			if inArgument {
+				arguments = append(arguments, argument.String())
+				argument.Reset()
+				inArgument = false
+			}
+		default:
+			argument.WriteRune(r)
+			inArgument = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("Value %v has an unterminated quote or escape", value)
+	}
+	if inArgument {
+		arguments = append(arguments, argument.String())
+	}
+	return arguments, nil
+}
+
+// getSourceURL returns the https url of the git repository, or an empty string if any part is unknown
+func getSourceURL(gitSource, gitOwner, gitName string) string {
+	if gitSource == "" || gitOwner == "" || gitName == "" {
+		return ""
+	}
+
+	// the source is normally a host like github.com, but strip any scheme or ssh user to be sure
+	host := regexp.MustCompile(`^([a-z+]+://)?([^@/]+@)?`).ReplaceAllString(gitSource, "")
+	host = strings.TrimSuffix(host, "/")
+
+	return fmt.Sprintf("https://%v/%v/%v", host, gitOwner, strings.TrimSuffix(gitName, ".git"))
+}
+
+func getDateTag(now time.Time, layout, timezone string) (string, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return "", fmt.Errorf("Value of dateTagTimezone %v is not a known timezone: %v", timezone, err)
+	}
+
+	// layouts with time of day contain colons, which aren't allowed in tags
+	return tidyBuildVersionAsTag(now.In(location).Format(layout)), nil
+}
+
+// removeDuplicateTags removes tags that occur more than once or equal the build version tag, which is always pushed
+func removeDuplicateTags(tags []string, buildVersionTag string) []string {
+	var uniqueTags []string
+	for _, t := range tags {
+		if t == buildVersionTag {
+			logInfo("Skipping tag %v, it's the same as the build version tag\n", t)
+			recordSkippedTag(t, "same as the build version tag")
+			continue
+		}
+		if contains(uniqueTags, t) {
+			logInfo("Skipping tag %v, it's listed more than once\n", t)
+			recordSkippedTag(t, "listed more than once")
+			continue
+		}
+		uniqueTags = append(uniqueTags, t)
+	}
+	return uniqueTags
+}
+
+// getPRTag returns the prefixed pull request number, or an empty string if it isn't a number; merge request ids like !123 or #123
+// are accepted as well
+func getPRTag(pullRequest, prefix string) string {
+	pullRequest = strings.TrimLeft(strings.TrimSpace(pullRequest), "#!")
+	if !regexp.MustCompile(`^[0-9]+$`).MatchString(pullRequest) {
+		return ""
+	}
+	return tidyBuildVersionAsTag(prefix + pullRequest)
+}
+
+// getStatusTag returns passed or failed for the Estafette build status, or an empty string for other statuses
+func getStatusTag(buildStatus string) string {
+	switch buildStatus {
+	case "succeeded":
+		return "passed"
+	case "failed":
+		return "failed"
+	}
+	return ""
+}
+
+// removeGatedTags removes the gated tags unless the branch is one of the allowed branches, and returns the removed tags
+func removeGatedTags(tagsSlice, gatedTags, branches []string, branch string) ([]string, []string) {
+	if branch != "" && contains(branches, branch) {
+		return tagsSlice, nil
+	}
+
+	var tags, skippedTags []string
+	for _, t := range tagsSlice {
+		if contains(gatedTags, t) {
+			skippedTags = append(skippedTags, t)
+			continue
+		}
+		tags = append(tags, t)
+	}
+	return tags, skippedTags
+}
+
+// sortTagsLatestLast sorts tags alphabetically, except for latest which is moved to the end so it's pushed last
+func sortTagsLatestLast(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i] == "latest" || tags[j] == "latest" {
+			return tags[j] == "latest" && tags[i] != "latest"
+		}
+		return tags[i] < tags[j]
+	})
+}
+
+func isPrereleaseVersion(buildVersion string) bool {
+	// a semantic version with a label, like 1.0.23-beta or 0.0.187-feature-x, is a prerelease
+	return strings.Contains(buildVersion, "-")
+}
+
+const maxTagLength = 128
+
+// validateTag checks the tag against the character set and maximum length for tags, and truncates it if it's too long and truncate is set
+func validateTag(tag string, truncate bool) (string, error) {
+	if len(tag) > maxTagLength {
+		if !truncate {
+			return "", fmt.Errorf("Tag %v is longer than %v characters, set `longTags: truncate` to truncate it", tag, maxTagLength)
+		}
+		logWarn("Truncating tag %v to %v characters\n", tag, maxTagLength)
+		tag = tag[:maxTagLength]
+	}
+	if !regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.\-]*$`).MatchString(tag) {
+		return "", fmt.Errorf("Tag %v can only contain letters, digits, underscores, periods and dashes and can't start with a period or dash", tag)
+	}
+	return tag, nil
 }
 
 func tidyBuildVersionAsTag(buildVersion string) string {
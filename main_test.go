@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	contracts "github.com/estafette/estafette-ci-contracts"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,3 +32,1397 @@ func TestTidyBuildVersionAsTag(t *testing.T) {
 	})
 
 }
+
+func TestSelectRepoDigest(t *testing.T) {
+	t.Run("ReturnsRepoDigestForRepository", func(t *testing.T) {
+
+		repoDigests := []string{
+			"extensions/docker@sha256:1111",
+			"gcr.io/extensions/docker@sha256:2222",
+		}
+
+		// act
+		repoDigest := selectRepoDigest(repoDigests, "gcr.io/extensions/docker")
+
+		assert.Equal(t, "gcr.io/extensions/docker@sha256:2222", repoDigest)
+	})
+
+	t.Run("ReturnsRepoDigestForFullyQualifiedDockerHubRepository", func(t *testing.T) {
+
+		repoDigests := []string{
+			"extensions/docker@sha256:1111",
+			"alpine@sha256:3333",
+		}
+
+		// act
+		repoDigest := selectRepoDigest(repoDigests, "docker.io/extensions/docker")
+		libraryRepoDigest := selectRepoDigest(repoDigests, "docker.io/library/alpine")
+
+		assert.Equal(t, "extensions/docker@sha256:1111", repoDigest)
+		assert.Equal(t, "alpine@sha256:3333", libraryRepoDigest)
+	})
+
+	t.Run("ReturnsEmptyStringIfRepositoryHasNoRepoDigest", func(t *testing.T) {
+
+		repoDigests := []string{
+			"extensions/docker@sha256:1111",
+		}
+
+		// act
+		repoDigest := selectRepoDigest(repoDigests, "extensions/docker-other")
+
+		assert.Equal(t, "", repoDigest)
+	})
+}
+
+func TestGetCPUQuota(t *testing.T) {
+	t.Run("ReturnsQuotaForFractionalCpus", func(t *testing.T) {
+
+		// act
+		quota, err := getCPUQuota("1.5")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 150000, quota)
+	})
+
+	t.Run("ReturnsErrorIfCpusIsNotANumber", func(t *testing.T) {
+
+		// act
+		_, err := getCPUQuota("two")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfCpusIsZero", func(t *testing.T) {
+
+		// act
+		_, err := getCPUQuota("0")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRenderRepositoryTemplate(t *testing.T) {
+	t.Run("ReturnsRepositoryContainerAndTagForDefaultTemplate", func(t *testing.T) {
+
+		// act
+		containerPath := renderRepositoryTemplate("{repository}/{container}:{tag}", "extensions", "docker", "1.0.0")
+
+		assert.Equal(t, "extensions/docker:1.0.0", containerPath)
+	})
+
+	t.Run("ReturnsNamespacedContainerPathForCustomTemplate", func(t *testing.T) {
+
+		// act
+		containerPath := renderRepositoryTemplate("{repository}/myorg/{container}:{tag}", "1234.dkr.ecr.eu-west-1.amazonaws.com", "docker", "1.0.0")
+
+		assert.Equal(t, "1234.dkr.ecr.eu-west-1.amazonaws.com/myorg/docker:1.0.0", containerPath)
+	})
+}
+
+func TestGetReferenceTemplate(t *testing.T) {
+	t.Run("ReturnsRepositoryTemplateForDockerStyle", func(t *testing.T) {
+
+		// act
+		template := getReferenceTemplate("docker", "", "{repository}/{container}:{tag}")
+
+		assert.Equal(t, "{repository}/{container}:{tag}", template)
+	})
+
+	t.Run("ReturnsTemplateWithNamespaceForNamespacedStyle", func(t *testing.T) {
+
+		// act
+		template := getReferenceTemplate("namespaced", "myproject/", "{repository}/{container}:{tag}")
+
+		assert.Equal(t, "{repository}/myproject/{container}:{tag}", template)
+	})
+}
+
+func TestIsValidBuildContext(t *testing.T) {
+	t.Run("ReturnsTrueForNameAndPath", func(t *testing.T) {
+
+		// act
+		valid := isValidBuildContext("shared=../shared")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsTrueForNameAndDockerImage", func(t *testing.T) {
+
+		// act
+		valid := isValidBuildContext("base=docker-image://alpine:3.8")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsFalseIfValueIsMissing", func(t *testing.T) {
+
+		// act
+		valid := isValidBuildContext("shared=")
+
+		assert.False(t, valid)
+	})
+
+	t.Run("ReturnsFalseIfNameIsMissing", func(t *testing.T) {
+
+		// act
+		valid := isValidBuildContext("../shared")
+
+		assert.False(t, valid)
+	})
+}
+
+func TestIsPrereleaseVersion(t *testing.T) {
+	t.Run("ReturnsFalseForVersionWithoutLabel", func(t *testing.T) {
+
+		// act
+		prerelease := isPrereleaseVersion("1.0.23")
+
+		assert.False(t, prerelease)
+	})
+
+	t.Run("ReturnsTrueForVersionWithLabel", func(t *testing.T) {
+
+		// act
+		prerelease := isPrereleaseVersion("0.0.187-release/release-x")
+
+		assert.True(t, prerelease)
+	})
+}
+
+func TestDecodeDockerConfigJSONAuths(t *testing.T) {
+	t.Run("ReturnsAuthsFromBase64EncodedDockerConfigJSON", func(t *testing.T) {
+
+		// {"auths":{"gcr.io":{"auth":"dXNlcjpwYXNz"}}}
+		encoded := "eyJhdXRocyI6eyJnY3IuaW8iOnsiYXV0aCI6ImRYTmxjanB3WVhOeiJ9fX0="
+
+		// act
+		auths, err := decodeDockerConfigJSONAuths(encoded)
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]interface{}{"gcr.io": map[string]interface{}{"auth": "dXNlcjpwYXNz"}}, auths)
+	})
+
+	t.Run("ReturnsErrorIfValueIsNotBase64", func(t *testing.T) {
+
+		// act
+		_, err := decodeDockerConfigJSONAuths("{\"auths\":{}}")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfDockerConfigJSONHasNoAuths", func(t *testing.T) {
+
+		// {}
+		encoded := "e30="
+
+		// act
+		_, err := decodeDockerConfigJSONAuths(encoded)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetDateTag(t *testing.T) {
+	t.Run("ReturnsDateInDefaultLayout", func(t *testing.T) {
+
+		now := time.Date(2018, 12, 31, 23, 30, 0, 0, time.UTC)
+
+		// act
+		tag, err := getDateTag(now, "2006-01-02", "UTC")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "2018-12-31", tag)
+	})
+
+	t.Run("ReturnsDateInTimezone", func(t *testing.T) {
+
+		now := time.Date(2018, 12, 31, 23, 30, 0, 0, time.UTC)
+
+		// act
+		tag, err := getDateTag(now, "2006-01-02", "Europe/Amsterdam")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "2019-01-01", tag)
+	})
+
+	t.Run("ReturnsColonsReplacedWithDash", func(t *testing.T) {
+
+		now := time.Date(2018, 12, 31, 23, 30, 0, 0, time.UTC)
+
+		// act
+		tag, err := getDateTag(now, "20060102T15:04", "UTC")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "20181231T23-30", tag)
+	})
+
+	t.Run("ReturnsErrorForUnknownTimezone", func(t *testing.T) {
+
+		// act
+		_, err := getDateTag(time.Now(), "2006-01-02", "Mars/Olympus_Mons")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSplitLabels(t *testing.T) {
+	t.Run("ReturnsLabelsSplitByComma", func(t *testing.T) {
+
+		// act
+		labels := splitLabels("team=estafette-team,language=golang")
+
+		assert.Equal(t, []string{"team=estafette-team", "language=golang"}, labels)
+	})
+
+	t.Run("ReturnsQuotedValueWithCommaAsSingleLabel", func(t *testing.T) {
+
+		// act
+		labels := splitLabels(`team=estafette-team,description="foo,bar"`)
+
+		assert.Equal(t, []string{"team=estafette-team", "description=foo,bar"}, labels)
+	})
+
+	t.Run("ReturnsEscapedCommaAsPartOfLabel", func(t *testing.T) {
+
+		// act
+		labels := splitLabels(`description=foo\,bar,team=estafette-team`)
+
+		assert.Equal(t, []string{"description=foo,bar", "team=estafette-team"}, labels)
+	})
+
+	t.Run("ReturnsEscapedQuoteAsPartOfLabel", func(t *testing.T) {
+
+		// act
+		labels := splitLabels(`description="say \"hi\", please"`)
+
+		assert.Equal(t, []string{`description=say "hi", please`}, labels)
+	})
+
+	t.Run("ReturnsNilForEmptyLabels", func(t *testing.T) {
+
+		// act
+		labels := splitLabels("")
+
+		assert.Nil(t, labels)
+	})
+}
+
+func TestSplitPatterns(t *testing.T) {
+	t.Run("KeepsBackslashesInPatterns", func(t *testing.T) {
+
+		// act
+		patterns := splitPatterns(`^v\d+\.\d+$,^\s*$`)
+
+		assert.Equal(t, []string{`^v\d+\.\d+$`, `^\s*$`}, patterns)
+	})
+
+	t.Run("KeepsCommasInQuotesOrAfterBackslash", func(t *testing.T) {
+
+		// act
+		patterns := splitPatterns(`"^[a-f0-9]{7,12}$",^x{1\,2}$`)
+
+		assert.Equal(t, []string{`^[a-f0-9]{7,12}$`, `^x{1,2}$`}, patterns)
+	})
+}
+
+func TestSortTagsLatestLast(t *testing.T) {
+	t.Run("SortsTagsAlphabetically", func(t *testing.T) {
+
+		tags := []string{"stable", "dev", "beta"}
+
+		// act
+		sortTagsLatestLast(tags)
+
+		assert.Equal(t, []string{"beta", "dev", "stable"}, tags)
+	})
+
+	t.Run("SortsLatestLast", func(t *testing.T) {
+
+		tags := []string{"latest", "stable", "2018-12-31", "zulu"}
+
+		// act
+		sortTagsLatestLast(tags)
+
+		assert.Equal(t, []string{"2018-12-31", "stable", "zulu", "latest"}, tags)
+	})
+}
+
+func TestIsValidAddHost(t *testing.T) {
+	t.Run("ReturnsTrueForHostAndIPv4Address", func(t *testing.T) {
+
+		// act
+		valid := isValidAddHost("database:10.0.0.12")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsTrueForHostAndIPv6Address", func(t *testing.T) {
+
+		// act
+		valid := isValidAddHost("database:fd00::12")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsTrueForHostGateway", func(t *testing.T) {
+
+		// act
+		valid := isValidAddHost("host.docker.internal:host-gateway")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsFalseForHostname", func(t *testing.T) {
+
+		// act
+		valid := isValidAddHost("database:db.internal")
+
+		assert.False(t, valid)
+	})
+
+	t.Run("ReturnsFalseIfIPIsMissing", func(t *testing.T) {
+
+		// act
+		valid := isValidAddHost("database")
+
+		assert.False(t, valid)
+	})
+}
+
+func TestGetPrefixedBuildArgs(t *testing.T) {
+	t.Run("ReturnsEnvironmentVariablesWithPrefixStripped", func(t *testing.T) {
+
+		environ := []string{"BUILDARG_VERSION=1.0.0", "HOME=/root", "BUILDARG_API_URL=https://api.example.com/?a=b"}
+
+		// act
+		buildArgs := getPrefixedBuildArgs(environ, "BUILDARG_")
+
+		assert.Equal(t, []string{"API_URL=https://api.example.com/?a=b", "VERSION=1.0.0"}, buildArgs)
+	})
+
+	t.Run("SkipsEnvironmentVariableEqualToPrefix", func(t *testing.T) {
+
+		environ := []string{"BUILDARG_=empty"}
+
+		// act
+		buildArgs := getPrefixedBuildArgs(environ, "BUILDARG_")
+
+		assert.Nil(t, buildArgs)
+	})
+}
+
+func TestSplitArguments(t *testing.T) {
+	t.Run("ReturnsArgumentsSplitOnWhitespace", func(t *testing.T) {
+
+		// act
+		arguments, err := splitArguments("--network host  --no-cache")
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"--network", "host", "--no-cache"}, arguments)
+	})
+
+	t.Run("ReturnsQuotedValuesAsSingleArgument", func(t *testing.T) {
+
+		// act
+		arguments, err := splitArguments(`--label "description=foo bar" --label 'quote="hi"'`)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"--label", "description=foo bar", "--label", `quote="hi"`}, arguments)
+	})
+
+	t.Run("ReturnsEscapedWhitespaceAsPartOfArgument", func(t *testing.T) {
+
+		// act
+		arguments, err := splitArguments(`--label description=foo\ bar`)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"--label", "description=foo bar"}, arguments)
+	})
+
+	t.Run("ReturnsEmptyQuotedArgument", func(t *testing.T) {
+
+		// act
+		arguments, err := splitArguments(`--build-arg ""`)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"--build-arg", ""}, arguments)
+	})
+
+	t.Run("ReturnsErrorForUnterminatedQuote", func(t *testing.T) {
+
+		// act
+		_, err := splitArguments(`--label "description=foo`)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestIsRepositoryInScope(t *testing.T) {
+	t.Run("ReturnsTrueIfRepositoryEqualsScope", func(t *testing.T) {
+
+		// act
+		inScope := isRepositoryInScope("gcr.io/myorg", []string{"extensions", "gcr.io/myorg"})
+
+		assert.True(t, inScope)
+	})
+
+	t.Run("ReturnsTrueIfRepositoryIsNestedInScope", func(t *testing.T) {
+
+		// act
+		inScope := isRepositoryInScope("gcr.io/myorg/team", []string{"gcr.io/myorg/"})
+
+		assert.True(t, inScope)
+	})
+
+	t.Run("ReturnsFalseIfRepositoryOnlySharesPrefixWithScope", func(t *testing.T) {
+
+		// act
+		inScope := isRepositoryInScope("gcr.io/myorg-other", []string{"gcr.io/myorg"})
+
+		assert.False(t, inScope)
+	})
+}
+
+func TestGetSourceURL(t *testing.T) {
+	t.Run("ReturnsHttpsURLForHost", func(t *testing.T) {
+
+		// act
+		sourceURL := getSourceURL("github.com", "estafette", "estafette-extension-docker")
+
+		assert.Equal(t, "https://github.com/estafette/estafette-extension-docker", sourceURL)
+	})
+
+	t.Run("ReturnsHttpsURLForSourceWithSchemeAndUser", func(t *testing.T) {
+
+		// act
+		sourceURL := getSourceURL("ssh://git@bitbucket.org/", "estafette", "estafette-extension-docker.git")
+
+		assert.Equal(t, "https://bitbucket.org/estafette/estafette-extension-docker", sourceURL)
+	})
+
+	t.Run("ReturnsEmptyStringIfOwnerIsUnknown", func(t *testing.T) {
+
+		// act
+		sourceURL := getSourceURL("github.com", "", "estafette-extension-docker")
+
+		assert.Equal(t, "", sourceURL)
+	})
+}
+
+func TestSplitRepositories(t *testing.T) {
+	t.Run("ReturnsCommaSeparatedRepositories", func(t *testing.T) {
+
+		// act
+		repositories := splitRepositories("extensions,gcr.io/estafette")
+
+		assert.Equal(t, []string{"extensions", "gcr.io/estafette"}, repositories)
+	})
+
+	t.Run("ReturnsNewlineSeparatedRepositoriesWithoutEmptyEntries", func(t *testing.T) {
+
+		// act
+		repositories := splitRepositories("extensions\r\n\n gcr.io/estafette ,\n")
+
+		assert.Equal(t, []string{"extensions", "gcr.io/estafette"}, repositories)
+	})
+
+	t.Run("ReturnsNilForEmptyString", func(t *testing.T) {
+
+		// act
+		repositories := splitRepositories("")
+
+		assert.Nil(t, repositories)
+	})
+}
+
+func TestRemoveDuplicateTags(t *testing.T) {
+	t.Run("ReturnsTagsWithoutBuildVersionTag", func(t *testing.T) {
+
+		// act
+		tags := removeDuplicateTags([]string{"main", "stable"}, "main")
+
+		assert.Equal(t, []string{"stable"}, tags)
+	})
+
+	t.Run("ReturnsTagsWithoutDuplicatesInOriginalOrder", func(t *testing.T) {
+
+		// act
+		tags := removeDuplicateTags([]string{"stable", "latest", "stable"}, "1.0.23")
+
+		assert.Equal(t, []string{"stable", "latest"}, tags)
+	})
+}
+
+func TestParseRepositoryDockerfiles(t *testing.T) {
+	t.Run("ReturnsDockerfilePerRepository", func(t *testing.T) {
+
+		// act
+		repositoryDockerfiles, repositoryContainers, err := parseRepositoryDockerfiles("extensions=Dockerfile.hardened;gcr.io/estafette=Dockerfile.debug")
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"extensions": "Dockerfile.hardened", "gcr.io/estafette": "Dockerfile.debug"}, repositoryDockerfiles)
+		assert.Equal(t, map[string]string{}, repositoryContainers)
+	})
+
+	t.Run("ReturnsContainerOverrideAfterDockerfile", func(t *testing.T) {
+
+		// act
+		repositoryDockerfiles, repositoryContainers, err := parseRepositoryDockerfiles("extensions=Dockerfile;gcr.io/estafette=Dockerfile.tools:app-tools")
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"extensions": "Dockerfile", "gcr.io/estafette": "Dockerfile.tools"}, repositoryDockerfiles)
+		assert.Equal(t, map[string]string{"gcr.io/estafette": "app-tools"}, repositoryContainers)
+	})
+
+	t.Run("ReturnsErrorIfDockerfileIsMissing", func(t *testing.T) {
+
+		// act
+		_, _, err := parseRepositoryDockerfiles("extensions")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfContainerIsEmpty", func(t *testing.T) {
+
+		// act
+		_, _, err := parseRepositoryDockerfiles("extensions=Dockerfile:")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGroupRepositoriesByDockerfile(t *testing.T) {
+	t.Run("ReturnsSingleGroupWithoutRepositoryDockerfiles", func(t *testing.T) {
+
+		// act
+		buildGroups := groupRepositoriesByDockerfile([]string{"extensions", "gcr.io/estafette"}, "Dockerfile", map[string]string{})
+
+		assert.Equal(t, []buildGroup{{dockerfile: "Dockerfile", repositories: []string{"extensions", "gcr.io/estafette"}}}, buildGroups)
+	})
+
+	t.Run("ReturnsGroupPerDistinctDockerfile", func(t *testing.T) {
+
+		// act
+		buildGroups := groupRepositoriesByDockerfile([]string{"extensions", "gcr.io/estafette", "quay.io/estafette"}, "Dockerfile", map[string]string{"gcr.io/estafette": "Dockerfile.debug"})
+
+		assert.Equal(t, []buildGroup{
+			{dockerfile: "Dockerfile", repositories: []string{"extensions", "quay.io/estafette"}},
+			{dockerfile: "Dockerfile.debug", repositories: []string{"gcr.io/estafette"}},
+		}, buildGroups)
+	})
+}
+
+func TestParseLabelFile(t *testing.T) {
+	t.Run("ReturnsLabelsSkippingCommentsAndBlankLines", func(t *testing.T) {
+
+		content := "# provenance\norg.opencontainers.image.revision=abc123\n\n  team=estafette-team  \n"
+
+		// act
+		labels := parseLabelFile(content)
+
+		assert.Equal(t, []string{"org.opencontainers.image.revision=abc123", "team=estafette-team"}, labels)
+	})
+}
+
+func TestMergeLabels(t *testing.T) {
+	t.Run("ReturnsOverridingLabelForSameKey", func(t *testing.T) {
+
+		// act
+		labels := mergeLabels([]string{"team=other-team", "language=golang"}, []string{"team=estafette-team"})
+
+		assert.Equal(t, []string{"language=golang", "team=estafette-team"}, labels)
+	})
+}
+
+func TestGetDigestTag(t *testing.T) {
+	t.Run("ReturnsFirst12CharactersOfDigest", func(t *testing.T) {
+
+		// act
+		tag := getDigestTag("sha256:4b1f7e6b2d9c8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f")
+
+		assert.Equal(t, "sha-4b1f7e6b2d9c", tag)
+	})
+}
+
+func TestMergeCredentials(t *testing.T) {
+	t.Run("ReturnsCredentialsFromBothLists", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "estafette", Username: "a"}}
+		overrides := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "gcr.io/project", Username: "b"}}
+
+		// act
+		merged := mergeCredentials(credentials, overrides)
+
+		assert.Equal(t, 2, len(merged))
+	})
+
+	t.Run("ReturnsOverrideForRepositoryInBothLists", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "estafette", Username: "a"}}
+		overrides := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "estafette", Username: "b"}}
+
+		// act
+		merged := mergeCredentials(credentials, overrides)
+
+		assert.Equal(t, 1, len(merged))
+		assert.Equal(t, "b", merged[0].Username)
+	})
+}
+
+func TestUnmarshalCredentials(t *testing.T) {
+	t.Run("ReturnsCredentialsWithoutEnvironment", func(t *testing.T) {
+
+		data := []byte(`[{"repository":"estafette","username":"a","password":"b"}]`)
+
+		// act
+		credentials, err := unmarshalCredentials(data, "")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(credentials))
+		assert.Equal(t, "estafette", credentials[0].Repository)
+		assert.Equal(t, "a", credentials[0].Username)
+	})
+
+	t.Run("ReturnsCredentialsForEnvironmentBeforeCredentialsWithoutEnvironment", func(t *testing.T) {
+
+		data := []byte(`[{"repository":"estafette","username":"any"},{"repository":"estafette","username":"dev","environment":"dev"},{"repository":"estafette","username":"prod","environment":"prod"}]`)
+
+		// act
+		credentials, err := unmarshalCredentials(data, "prod")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(credentials))
+		assert.Equal(t, "prod", credentials[0].Username)
+		assert.Equal(t, "any", credentials[1].Username)
+	})
+}
+
+func TestGetBaseImages(t *testing.T) {
+	t.Run("ReturnsImagesFromFromInstructions", func(t *testing.T) {
+
+		dockerfileContent := "FROM --platform=linux/amd64 golang:1.11 AS builder\nRUN go build\n\nFROM alpine:3.8\nCOPY --from=builder /app /app\n"
+
+		// act
+		baseImages := getBaseImages(dockerfileContent)
+
+		assert.Equal(t, []string{"golang:1.11", "alpine:3.8"}, baseImages)
+	})
+
+	t.Run("SkipsScratchBuildStagesAndBuildArguments", func(t *testing.T) {
+
+		dockerfileContent := "ARG BASE=alpine:3.8\nFROM golang:1.11 AS builder\nFROM builder AS tester\nFROM ${BASE}\nFROM scratch\n"
+
+		// act
+		baseImages := getBaseImages(dockerfileContent)
+
+		assert.Equal(t, []string{"golang:1.11"}, baseImages)
+	})
+}
+
+func TestGetManifestDigest(t *testing.T) {
+	t.Run("ReturnsDescriptorDigestForSinglePlatformImage", func(t *testing.T) {
+
+		manifestOutput := []byte(`{"Ref":"docker.io/library/alpine:3.8","Descriptor":{"mediaType":"application/vnd.docker.distribution.manifest.v2+json","digest":"sha256:a9d8b4a2","size":528}}`)
+
+		// act
+		digest, err := getManifestDigest(manifestOutput, "linux", "amd64")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:a9d8b4a2", digest)
+	})
+
+	t.Run("ReturnsDigestForPlatformOfMultiPlatformImage", func(t *testing.T) {
+
+		manifestOutput := []byte(`[{"Descriptor":{"digest":"sha256:0b2a0e4f","platform":{"architecture":"arm64","os":"linux"}}},{"Descriptor":{"digest":"sha256:7c3773f7","platform":{"architecture":"amd64","os":"linux"}}}]`)
+
+		// act
+		digest, err := getManifestDigest(manifestOutput, "linux", "amd64")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:7c3773f7", digest)
+	})
+
+	t.Run("ReturnsErrorIfPlatformIsMissing", func(t *testing.T) {
+
+		manifestOutput := []byte(`[{"Descriptor":{"digest":"sha256:0b2a0e4f","platform":{"architecture":"arm64","os":"linux"}}}]`)
+
+		// act
+		_, err := getManifestDigest(manifestOutput, "linux", "amd64")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestPinBaseImageDigests(t *testing.T) {
+	t.Run("AppendsDigestToFromImages", func(t *testing.T) {
+
+		dockerfileContent := "FROM --platform=linux/amd64 golang:1.11 AS builder\nRUN go build\n\nFROM alpine:3.8\nCOPY --from=builder /app /app\n"
+
+		// act
+		pinnedDockerfileContent := pinBaseImageDigests(dockerfileContent, map[string]string{"golang:1.11": "sha256:5f2a1c0d", "alpine:3.8": "sha256:a9d8b4a2"})
+
+		assert.Equal(t, "FROM --platform=linux/amd64 golang:1.11@sha256:5f2a1c0d AS builder\nRUN go build\n\nFROM alpine:3.8@sha256:a9d8b4a2\nCOPY --from=builder /app /app\n", pinnedDockerfileContent)
+	})
+}
+
+func TestGetManifestConfigDigests(t *testing.T) {
+	t.Run("ReturnsConfigDigestForSinglePlatformImage", func(t *testing.T) {
+
+		manifestOutput := []byte(`{"Ref":"docker.io/library/alpine:3.8","SchemaV2Manifest":{"config":{"digest":"sha256:abc"}}}`)
+
+		// act
+		configDigests, err := getManifestConfigDigests(manifestOutput)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"sha256:abc"}, configDigests)
+	})
+
+	t.Run("ReturnsConfigDigestsForMultiPlatformImage", func(t *testing.T) {
+
+		manifestOutput := []byte(`[{"SchemaV2Manifest":{"config":{"digest":"sha256:abc"}}},{"SchemaV2Manifest":{"config":{"digest":"sha256:def"}}}]`)
+
+		// act
+		configDigests, err := getManifestConfigDigests(manifestOutput)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"sha256:abc", "sha256:def"}, configDigests)
+	})
+}
+
+func TestRemoveGatedTags(t *testing.T) {
+	t.Run("ReturnsAllTagsForAllowedBranch", func(t *testing.T) {
+
+		// act
+		tags, skippedTags := removeGatedTags([]string{"dev", "stable"}, []string{"stable", "latest"}, []string{"main", "master"}, "main")
+
+		assert.Equal(t, []string{"dev", "stable"}, tags)
+		assert.Nil(t, skippedTags)
+	})
+
+	t.Run("RemovesGatedTagsForOtherBranch", func(t *testing.T) {
+
+		// act
+		tags, skippedTags := removeGatedTags([]string{"dev", "stable"}, []string{"stable", "latest"}, []string{"main", "master"}, "feature-x")
+
+		assert.Equal(t, []string{"dev"}, tags)
+		assert.Equal(t, []string{"stable"}, skippedTags)
+	})
+
+	t.Run("RemovesGatedTagsIfBranchIsUnknown", func(t *testing.T) {
+
+		// act
+		tags, skippedTags := removeGatedTags([]string{"latest"}, []string{"stable", "latest"}, []string{"main", "master"}, "")
+
+		assert.Nil(t, tags)
+		assert.Equal(t, []string{"latest"}, skippedTags)
+	})
+}
+
+func TestGetProxyVariables(t *testing.T) {
+	t.Run("ReturnsNilIfNoProxyIsSet", func(t *testing.T) {
+
+		// act
+		proxyVariables := getProxyVariables("", "", "")
+
+		assert.Nil(t, proxyVariables)
+	})
+
+	t.Run("ReturnsUpperAndLowerCaseVariablesForSetProxies", func(t *testing.T) {
+
+		// act
+		proxyVariables := getProxyVariables("http://proxy:3128", "", "localhost")
+
+		assert.Equal(t, []string{"HTTP_PROXY=http://proxy:3128", "http_proxy=http://proxy:3128", "NO_PROXY=localhost", "no_proxy=localhost"}, proxyVariables)
+	})
+}
+
+func TestValidateTag(t *testing.T) {
+	t.Run("ReturnsTagIfValid", func(t *testing.T) {
+
+		// act
+		tag, err := validateTag("1.0.0-feature-x", false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "1.0.0-feature-x", tag)
+	})
+
+	t.Run("ReturnsErrorForInvalidCharacters", func(t *testing.T) {
+
+		// act
+		_, err := validateTag("feature/x", false)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForLeadingPeriod", func(t *testing.T) {
+
+		// act
+		_, err := validateTag(".hidden", false)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForTagOver128Characters", func(t *testing.T) {
+
+		// act
+		_, err := validateTag(strings.Repeat("a", 129), false)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsTruncatedTagOver128CharactersIfTruncateIsSet", func(t *testing.T) {
+
+		// act
+		tag, err := validateTag(strings.Repeat("a", 129), true)
+
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Repeat("a", 128), tag)
+	})
+}
+
+func TestGetSyntaxDirective(t *testing.T) {
+	t.Run("ReturnsFrontendFromSyntaxDirective", func(t *testing.T) {
+
+		// act
+		frontend := getSyntaxDirective("# syntax=docker/dockerfile:1.4.3\nFROM alpine:3.8\n")
+
+		assert.Equal(t, "docker/dockerfile:1.4.3", frontend)
+	})
+
+	t.Run("ReturnsEmptyStringForSyntaxCommentAfterInstruction", func(t *testing.T) {
+
+		// act
+		frontend := getSyntaxDirective("FROM alpine:3.8\n# syntax=docker/dockerfile:1.4.3\n")
+
+		assert.Equal(t, "", frontend)
+	})
+}
+
+func TestIsPinnedFrontend(t *testing.T) {
+	t.Run("ReturnsTrueForFullVersion", func(t *testing.T) {
+
+		// act
+		pinned := isPinnedFrontend("docker/dockerfile:1.4.3")
+
+		assert.True(t, pinned)
+	})
+
+	t.Run("ReturnsTrueForDigest", func(t *testing.T) {
+
+		// act
+		pinned := isPinnedFrontend("docker/dockerfile@sha256:9ba7531bd80fb0a858632727cf7a112fbfd19b17e94c4e84ced81e24ef1a0dbc")
+
+		assert.True(t, pinned)
+	})
+
+	t.Run("ReturnsFalseForMajorVersion", func(t *testing.T) {
+
+		// act
+		pinned := isPinnedFrontend("docker/dockerfile:1")
+
+		assert.False(t, pinned)
+	})
+}
+
+func TestGetCosignSignArgs(t *testing.T) {
+	t.Run("ReturnsKeyArgumentIfKeyIsSet", func(t *testing.T) {
+
+		// act
+		args := getCosignSignArgs("/secrets/cosign.key", "extensions/docker:1.0.0")
+
+		assert.Equal(t, []string{"sign", "--key", "/secrets/cosign.key", "--yes", "extensions/docker:1.0.0"}, args)
+	})
+
+	t.Run("ReturnsNoKeyArgumentForKeylessSigning", func(t *testing.T) {
+
+		// act
+		args := getCosignSignArgs("", "extensions/docker:1.0.0")
+
+		assert.Equal(t, []string{"sign", "--yes", "extensions/docker:1.0.0"}, args)
+	})
+}
+
+func TestIsLoginAuthFailure(t *testing.T) {
+	t.Run("ReturnsTrueForUnauthorized", func(t *testing.T) {
+
+		// act
+		authFailure := isLoginAuthFailure("Error response from daemon: Get https://registry.internal/v2/: unauthorized: incorrect username or password")
+
+		assert.True(t, authFailure)
+	})
+
+	t.Run("ReturnsFalseForRateLimit", func(t *testing.T) {
+
+		// act
+		authFailure := isLoginAuthFailure("Error response from daemon: toomanyrequests: too many requests")
+
+		assert.False(t, authFailure)
+	})
+
+	t.Run("ReturnsFalseForNetworkError", func(t *testing.T) {
+
+		// act
+		authFailure := isLoginAuthFailure("Error response from daemon: Get https://registry.internal/v2/: net/http: TLS handshake timeout")
+
+		assert.False(t, authFailure)
+	})
+}
+
+func TestGetStatusTag(t *testing.T) {
+	t.Run("ReturnsPassedForSucceededBuild", func(t *testing.T) {
+
+		// act
+		tag := getStatusTag("succeeded")
+
+		assert.Equal(t, "passed", tag)
+	})
+
+	t.Run("ReturnsFailedForFailedBuild", func(t *testing.T) {
+
+		// act
+		tag := getStatusTag("failed")
+
+		assert.Equal(t, "failed", tag)
+	})
+
+	t.Run("ReturnsEmptyStringForRunningBuild", func(t *testing.T) {
+
+		// act
+		tag := getStatusTag("running")
+
+		assert.Equal(t, "", tag)
+	})
+}
+
+func TestPrefixRegistryHost(t *testing.T) {
+	t.Run("ReturnsRepositoryPrefixedWithRegistryHost", func(t *testing.T) {
+
+		// act
+		repository := prefixRegistryHost("myorg", "registry.internal")
+
+		assert.Equal(t, "registry.internal/myorg", repository)
+	})
+
+	t.Run("ReturnsRepositoryWithHostUnchanged", func(t *testing.T) {
+
+		// act
+		repository := prefixRegistryHost("gcr.io/myorg", "registry.internal")
+
+		assert.Equal(t, "gcr.io/myorg", repository)
+	})
+
+	t.Run("ReturnsRepositoryWithHostAndPortUnchanged", func(t *testing.T) {
+
+		// act
+		repository := prefixRegistryHost("localhost:5000/myorg", "registry.internal")
+
+		assert.Equal(t, "localhost:5000/myorg", repository)
+	})
+}
+
+func TestIsEncryptedSecret(t *testing.T) {
+	t.Run("ReturnsTrueForUndecryptedEstafetteSecret", func(t *testing.T) {
+
+		// act
+		encrypted := isEncryptedSecret("estafette.secret(deFTz5Bdjg6SUe29.oPIkXbze5G9PNEWS2-ZnArl8BCqHnx4MdTdxHg37th9u)")
+
+		assert.True(t, encrypted)
+	})
+
+	t.Run("ReturnsFalseForDecryptedValue", func(t *testing.T) {
+
+		// act
+		encrypted := isEncryptedSecret("s3cr3t")
+
+		assert.False(t, encrypted)
+	})
+}
+
+func TestGetCiBuildArgs(t *testing.T) {
+	t.Run("ReturnsAllCiBuildArgs", func(t *testing.T) {
+
+		// act
+		buildArgs := getCiBuildArgs("1.0.0", "a1b2c3", "main", []string{""})
+
+		assert.Equal(t, []string{"CI=true", "BUILD_VERSION=1.0.0", "GIT_REVISION=a1b2c3", "GIT_BRANCH=main"}, buildArgs)
+	})
+
+	t.Run("ReturnsCiBuildArgsWithoutExcludedNames", func(t *testing.T) {
+
+		// act
+		buildArgs := getCiBuildArgs("1.0.0", "a1b2c3", "main", []string{"GIT_BRANCH", "CI"})
+
+		assert.Equal(t, []string{"BUILD_VERSION=1.0.0", "GIT_REVISION=a1b2c3"}, buildArgs)
+	})
+}
+
+func TestIsValidReferenceWithTag(t *testing.T) {
+	t.Run("ReturnsTrueForReferenceWithTag", func(t *testing.T) {
+
+		// act
+		valid := isValidReferenceWithTag("mirror.registry.io:5000/extensions/docker:stable")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsFalseForReferenceWithoutTag", func(t *testing.T) {
+
+		// act
+		valid := isValidReferenceWithTag("mirror.registry.io:5000/extensions/docker")
+
+		assert.False(t, valid)
+	})
+
+	t.Run("ReturnsFalseForReferenceWithDigest", func(t *testing.T) {
+
+		// act
+		valid := isValidReferenceWithTag("mirror.registry.io/extensions/docker@sha256:4b1f7e6b2d9c8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f")
+
+		assert.False(t, valid)
+	})
+}
+
+func TestGetCredentialsForHost(t *testing.T) {
+	t.Run("ReturnsCredentialsForRepositoryOnSameHost", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "estafette"}, {Repository: "mirror.registry.io/team"}}
+
+		// act
+		credential := getCredentialsForHost(credentials, "mirror.registry.io/extensions/docker:stable")
+
+		assert.Equal(t, "mirror.registry.io/team", credential.Repository)
+	})
+
+	t.Run("ReturnsNilIfNoRepositoryIsOnSameHost", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "gcr.io/team"}}
+
+		// act
+		credential := getCredentialsForHost(credentials, "mirror.registry.io/extensions/docker:stable")
+
+		assert.Nil(t, credential)
+	})
+}
+
+func TestReadDockerfile(t *testing.T) {
+	t.Run("ReturnsInlineDockerfileIfSet", func(t *testing.T) {
+
+		// act
+		content, err := readDockerfile("FROM alpine:3.8\n", "Dockerfile")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "FROM alpine:3.8\n", string(content))
+	})
+}
+
+func TestGetSourcePullPolicy(t *testing.T) {
+	t.Run("ReturnsPolicyIfSet", func(t *testing.T) {
+
+		// act
+		policy := getSourcePullPolicy("if-not-present", true)
+
+		assert.Equal(t, "if-not-present", policy)
+	})
+
+	t.Run("ReturnsAlwaysIfPolicyIsNotSetAndPullSourceIsTrue", func(t *testing.T) {
+
+		// act
+		policy := getSourcePullPolicy("", true)
+
+		assert.Equal(t, "always", policy)
+	})
+
+	t.Run("ReturnsNeverIfPolicyIsNotSetAndPullSourceIsFalse", func(t *testing.T) {
+
+		// act
+		policy := getSourcePullPolicy("", false)
+
+		assert.Equal(t, "never", policy)
+	})
+}
+
+func TestGetRequiredBuildArgs(t *testing.T) {
+	t.Run("ReturnsArgsWithoutDefaultBeforeFirstFrom", func(t *testing.T) {
+
+		dockerfileContent := "ARG BASE_IMAGE\nARG VERSION=1.0.0\nARG REGISTRY GOPROXY=direct\nFROM ${REGISTRY}/${BASE_IMAGE}\nARG STAGE_ARG\n"
+
+		// act
+		requiredArgs := getRequiredBuildArgs(dockerfileContent)
+
+		assert.Equal(t, []string{"BASE_IMAGE", "REGISTRY"}, requiredArgs)
+	})
+}
+
+func TestGetMissingBuildArgs(t *testing.T) {
+	t.Run("ReturnsRequiredArgsThatAreNotPassed", func(t *testing.T) {
+
+		// act
+		missingArgs := getMissingBuildArgs([]string{"BASE_IMAGE", "REGISTRY", "GOPROXY"}, []string{"build", "--build-arg", "BASE_IMAGE=alpine:3.8", "--build-arg=GOPROXY=direct", "--file", "Dockerfile", "."})
+
+		assert.Equal(t, []string{"REGISTRY"}, missingArgs)
+	})
+}
+
+func TestGetPRTag(t *testing.T) {
+	t.Run("ReturnsPrefixedPullRequestNumber", func(t *testing.T) {
+
+		// act
+		tag := getPRTag("123", "pr-")
+
+		assert.Equal(t, "pr-123", tag)
+	})
+
+	t.Run("ReturnsPrefixedMergeRequestID", func(t *testing.T) {
+
+		// act
+		tag := getPRTag("!45", "mr-")
+
+		assert.Equal(t, "mr-45", tag)
+	})
+
+	t.Run("ReturnsEmptyStringIfNotAPullRequestBuild", func(t *testing.T) {
+
+		// act
+		tag := getPRTag("", "pr-")
+
+		assert.Equal(t, "", tag)
+	})
+}
+
+func TestGetWrapperDockerfile(t *testing.T) {
+	t.Run("ReturnsDockerfileWithWrapperBeforeEntrypointAndOriginalCmd", func(t *testing.T) {
+
+		// act
+		dockerfile := getWrapperDockerfile("extensions/docker:1.0.0", []string{"/app"}, []string{"--port", "8080"})
+
+		assert.Equal(t, "FROM extensions/docker:1.0.0\nCOPY wrapper /estafette-entrypoint-wrapper\nENTRYPOINT [\"/estafette-entrypoint-wrapper\",\"/app\"]\nCMD [\"--port\",\"8080\"]\n", dockerfile)
+	})
+
+	t.Run("ReturnsDockerfileWithoutCmdIfImageHasNone", func(t *testing.T) {
+
+		// act
+		dockerfile := getWrapperDockerfile("extensions/docker:1.0.0", nil, nil)
+
+		assert.Equal(t, "FROM extensions/docker:1.0.0\nCOPY wrapper /estafette-entrypoint-wrapper\nENTRYPOINT [\"/estafette-entrypoint-wrapper\"]\n", dockerfile)
+	})
+}
+
+func TestGetBuildContextImage(t *testing.T) {
+	t.Run("ReturnsImageReferenceForDockerImageContext", func(t *testing.T) {
+
+		// act
+		image := getBuildContextImage("base=docker-image://registry.internal/myorg/base:1.0.0")
+
+		assert.Equal(t, "registry.internal/myorg/base:1.0.0", image)
+	})
+
+	t.Run("ReturnsEmptyStringForPathContext", func(t *testing.T) {
+
+		// act
+		image := getBuildContextImage("shared=../shared")
+
+		assert.Equal(t, "", image)
+	})
+}
+
+func TestSplitExistingReferences(t *testing.T) {
+	t.Run("SkipsReferencesThatExistInTheRegistry", func(t *testing.T) {
+
+		existing := []string{"extensions/docker:1.0.0"}
+
+		// act
+		missingReferences, existingReferences, err := splitExistingReferences([]string{"extensions/docker:1.0.0", "extensions/docker:stable"}, func(reference string) (bool, error) {
+			return contains(existing, reference), nil
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"extensions/docker:stable"}, missingReferences)
+		assert.Equal(t, []string{"extensions/docker:1.0.0"}, existingReferences)
+	})
+
+	t.Run("ReturnsErrorIfLookupFails", func(t *testing.T) {
+
+		// act
+		_, _, err := splitExistingReferences([]string{"extensions/docker:1.0.0"}, func(reference string) (bool, error) {
+			return false, errors.New("toomanyrequests: rate limit exceeded")
+		})
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestIsManifestNotFound(t *testing.T) {
+	t.Run("ReturnsTrueForMissingManifest", func(t *testing.T) {
+
+		// act
+		notFound := isManifestNotFound("no such manifest: docker.io/extensions/docker:stable\n")
+
+		assert.True(t, notFound)
+	})
+
+	t.Run("ReturnsTrueForUnknownManifest", func(t *testing.T) {
+
+		// act
+		notFound := isManifestNotFound("manifest unknown: manifest unknown\n")
+
+		assert.True(t, notFound)
+	})
+
+	t.Run("ReturnsFalseForAuthenticationError", func(t *testing.T) {
+
+		// act
+		notFound := isManifestNotFound("unauthorized: authentication required\n")
+
+		assert.False(t, notFound)
+	})
+
+	t.Run("ReturnsFalseForRateLimitError", func(t *testing.T) {
+
+		// act
+		notFound := isManifestNotFound("toomanyrequests: You have reached your pull rate limit\n")
+
+		assert.False(t, notFound)
+	})
+}
+
+func TestParseInspectedLabel(t *testing.T) {
+	t.Run("ReturnsLabelValue", func(t *testing.T) {
+
+		// act
+		value := parseInspectedLabel("src-4f2a1c0d9e8b\n")
+
+		assert.Equal(t, "src-4f2a1c0d9e8b", value)
+	})
+
+	t.Run("ReturnsEmptyStringForMissingLabel", func(t *testing.T) {
+
+		// act
+		value := parseInspectedLabel("<no value>\n")
+
+		assert.Equal(t, "", value)
+	})
+}
+
+func TestGetCredentialsForContainer(t *testing.T) {
+	t.Run("ReturnsCredentialsForRepositoryWithoutLastSegment", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "extensions", Username: "estafette"}}
+
+		// act
+		credential := getCredentialsForContainer(credentials, "extensions/docker:1.0.0")
+
+		assert.Equal(t, credentials[0], credential)
+	})
+
+	t.Run("ReturnsCredentialsForRepositoryOfTemplatedReference", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{
+			{Repository: "gcr.io", Username: "_json_key"},
+			{Repository: "gcr.io/estafette", Username: "estafette"},
+			{Repository: "gcr.io/estafette-other", Username: "other"},
+		}
+
+		// act
+		credential := getCredentialsForContainer(credentials, "gcr.io/estafette/myorg/docker:1.0.0")
+
+		assert.Equal(t, credentials[1], credential)
+	})
+
+	t.Run("ReturnsNilIfNoRepositoryMatches", func(t *testing.T) {
+
+		credentials := []*contracts.ContainerRepositoryCredentialConfig{{Repository: "gcr.io/estafette", Username: "estafette"}}
+
+		// act
+		credential := getCredentialsForContainer(credentials, "quay.io/estafette/docker:1.0.0")
+
+		assert.Nil(t, credential)
+	})
+}
+
+func TestSuffixTagsWithArch(t *testing.T) {
+	t.Run("AppendsArchToBuildVersionTagAndTags", func(t *testing.T) {
+
+		// act
+		buildVersionTag, tags := suffixTagsWithArch("1.0.0", []string{"stable", "latest"}, "arm64")
+
+		assert.Equal(t, "1.0.0-arm64", buildVersionTag)
+		assert.Equal(t, []string{"stable-arm64", "latest-arm64"}, tags)
+	})
+
+	t.Run("LeavesEmptyBuildVersionTagEmpty", func(t *testing.T) {
+
+		// act
+		buildVersionTag, tags := suffixTagsWithArch("", []string{"stable"}, "amd64")
+
+		assert.Equal(t, "", buildVersionTag)
+		assert.Equal(t, []string{"stable-amd64"}, tags)
+	})
+}
+
+func TestIsVersionAtLeast(t *testing.T) {
+	t.Run("ReturnsFalseForOlderVersion", func(t *testing.T) {
+
+		// act
+		atLeast := isVersionAtLeast("18.09.0", "19.03")
+
+		assert.False(t, atLeast)
+	})
+
+	t.Run("ReturnsTrueForSameVersion", func(t *testing.T) {
+
+		// act
+		atLeast := isVersionAtLeast("19.03.0", "19.03")
+
+		assert.True(t, atLeast)
+	})
+
+	t.Run("ReturnsTrueForNewerPrereleaseVersion", func(t *testing.T) {
+
+		// act
+		atLeast := isVersionAtLeast("23.0.1-rc.1", "19.03")
+
+		assert.True(t, atLeast)
+	})
+
+	t.Run("ReturnsFalseForUnknownVersion", func(t *testing.T) {
+
+		// act
+		atLeast := isVersionAtLeast("", "19.03")
+
+		assert.False(t, atLeast)
+	})
+}
+
+func TestGetInvalidActionMessage(t *testing.T) {
+	t.Run("ReturnsMessageToSetActionIfEmpty", func(t *testing.T) {
+
+		// act
+		message := getInvalidActionMessage("")
+
+		assert.Equal(t, "No action set; set `action: <action>` on this step to one of build, push, tag, build-and-push, exists, placeholder, sign", message)
+	})
+
+	t.Run("ReturnsValidActionsForUnknownAction", func(t *testing.T) {
+
+		// act
+		message := getInvalidActionMessage("deploy")
+
+		assert.Equal(t, "Unknown action 'deploy'; valid actions are build, push, tag, build-and-push, exists, placeholder, sign", message)
+	})
+}
+
+func TestMoveTagsAfterVerifying(t *testing.T) {
+	t.Run("DoesNotVerifyBuildVersionTagWithoutTagsToMove", func(t *testing.T) {
+
+		sourceRequested := false
+
+		// act
+		moveTagsAfterVerifying(nil, []string{"extensions"}, "1.0.0", func(r string) string {
+			sourceRequested = true
+			return "extensions/docker:1.0.0"
+		}, nil)
+
+		assert.False(t, sourceRequested)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actionStartTime is set at the start of main, to push the action duration as metric
+var actionStartTime = time.Now()
+
+// metricsPushed prevents pushing twice, when pushing the metrics itself ends in a fatal error
+var metricsPushed = false
+
+// pushMetrics pushes the metrics of this action to the pushgateway, grouped by pipeline; any failure is only logged
+func pushMetrics(success bool) {
+	if *metricsPushgateway == "" || metricsPushed {
+		return
+	}
+	metricsPushed = true
+
+	imageSizes := map[string]int64{}
+	for _, b := range output.Built {
+		sizeOutput, err := dockerCommand("image", "inspect", "--format", "{{.Size}}", b).Output()
+		if err != nil {
+			continue
+		}
+		if size, err := strconv.ParseInt(strings.TrimSpace(string(sizeOutput)), 10, 64); err == nil {
+			imageSizes[b] = size
+		}
+	}
+
+	metricsURL := getPushgatewayURL(*metricsPushgateway, os.Getenv("ESTAFETTE_GIT_NAME"))
+	body := formatMetrics(*action, time.Since(actionStartTime).Seconds(), success, imageSizes)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	request, err := http.NewRequest("PUT", metricsURL, strings.NewReader(body))
+	if err != nil {
+		logWarn("Pushing metrics to %v failed: %v\n", metricsURL, err)
+		return
+	}
+	request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	response, err := client.Do(request)
+	if err != nil {
+		logWarn("Pushing metrics to %v failed: %v\n", metricsURL, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logWarn("Pushing metrics to %v failed with status %v\n", metricsURL, response.Status)
+		return
+	}
+	logInfo("Pushed metrics to %v\n", metricsURL)
+}
+
+// getPushgatewayURL returns the url for the metrics of this job, grouped by pipeline if it's known
+func getPushgatewayURL(pushgateway, pipeline string) string {
+	metricsURL := strings.TrimSuffix(pushgateway, "/") + "/metrics/job/estafette-extension-docker"
+	if pipeline != "" {
+		metricsURL += "/pipeline/" + url.PathEscape(pipeline)
+	}
+	return metricsURL
+}
+
+// formatMetrics returns the metrics in the Prometheus text format
+func formatMetrics(action string, durationSeconds float64, success bool, imageSizes map[string]int64) string {
+	successValue := 0
+	if success {
+		successValue = 1
+	}
+
+	var metrics strings.Builder
+	fmt.Fprintf(&metrics, "# TYPE estafette_extension_docker_action_duration_seconds gauge\n")
+	fmt.Fprintf(&metrics, "estafette_extension_docker_action_duration_seconds{action=%q} %v\n", action, durationSeconds)
+	fmt.Fprintf(&metrics, "# TYPE estafette_extension_docker_action_success gauge\n")
+	fmt.Fprintf(&metrics, "estafette_extension_docker_action_success{action=%q} %v\n", action, successValue)
+
+	if len(imageSizes) > 0 {
+		var images []string
+		for i := range imageSizes {
+			images = append(images, i)
+		}
+		sort.Strings(images)
+
+		fmt.Fprintf(&metrics, "# TYPE estafette_extension_docker_image_size_bytes gauge\n")
+		for _, i := range images {
+			fmt.Fprintf(&metrics, "estafette_extension_docker_image_size_bytes{image=%q} %v\n", i, imageSizes[i])
+		}
+	}
+
+	return metrics.String()
+}
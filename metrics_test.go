@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPushgatewayURL(t *testing.T) {
+	t.Run("ReturnsJobURLGroupedByPipeline", func(t *testing.T) {
+
+		// act
+		metricsURL := getPushgatewayURL("http://pushgateway:9091/", "estafette-extension-docker")
+
+		assert.Equal(t, "http://pushgateway:9091/metrics/job/estafette-extension-docker/pipeline/estafette-extension-docker", metricsURL)
+	})
+
+	t.Run("ReturnsJobURLIfPipelineIsUnknown", func(t *testing.T) {
+
+		// act
+		metricsURL := getPushgatewayURL("http://pushgateway:9091", "")
+
+		assert.Equal(t, "http://pushgateway:9091/metrics/job/estafette-extension-docker", metricsURL)
+	})
+}
+
+func TestFormatMetrics(t *testing.T) {
+	t.Run("ReturnsDurationSuccessAndImageSizes", func(t *testing.T) {
+
+		// act
+		metrics := formatMetrics("build", 12.5, true, map[string]int64{"extensions/docker:1.0.0": 1024})
+
+		assert.Equal(t, `# TYPE estafette_extension_docker_action_duration_seconds gauge
+estafette_extension_docker_action_duration_seconds{action="build"} 12.5
+# TYPE estafette_extension_docker_action_success gauge
+estafette_extension_docker_action_success{action="build"} 1
+# TYPE estafette_extension_docker_image_size_bytes gauge
+estafette_extension_docker_image_size_bytes{image="extensions/docker:1.0.0"} 1024
+`, metrics)
+	})
+}
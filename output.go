@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// actionOutput is the json summary written to outputFile after the action completes
+type actionOutput struct {
+	Action        string          `json:"action"`
+	Built         []string        `json:"built,omitempty"`
+	SkippedBuilds []skippedOutput `json:"skippedBuilds,omitempty"`
+	Images        []imageOutput   `json:"images,omitempty"`
+	SkippedTags   []skippedOutput `json:"skippedTags,omitempty"`
+	Signed        []string        `json:"signed,omitempty"`
+	Logins        []loginOutput   `json:"logins,omitempty"`
+}
+
+type skippedOutput struct {
+	Reference string `json:"reference"`
+	Reason    string `json:"reason"`
+}
+
+type imageOutput struct {
+	Reference string `json:"reference"`
+	Tag       string `json:"tag"`
+	Retention string `json:"retention"`
+}
+
+// loginOutput is a registry login performed with the credential, without its password
+type loginOutput struct {
+	Repository string `json:"repository"`
+	Server     string `json:"server"`
+	Username   string `json:"username"`
+}
+
+var output actionOutput
+
+func recordPushedImage(reference, tag string) {
+	output.Images = append(output.Images, imageOutput{
+		Reference: reference,
+		Tag:       tag,
+		Retention: getRetention(retentionRules, tag),
+	})
+}
+
+func recordBuiltImage(reference string) {
+	output.Built = append(output.Built, reference)
+}
+
+func recordSkippedBuild(reference, reason string) {
+	output.SkippedBuilds = append(output.SkippedBuilds, skippedOutput{Reference: reference, Reason: reason})
+}
+
+func recordSkippedTag(tag, reason string) {
+	output.SkippedTags = append(output.SkippedTags, skippedOutput{Reference: tag, Reason: reason})
+}
+
+func recordSignedImage(reference string) {
+	output.Signed = append(output.Signed, reference)
+}
+
+// recordLogin records each distinct login once, since the same credential is used for multiple images
+func recordLogin(repository, server, username string) {
+	login := loginOutput{Repository: repository, Server: server, Username: username}
+	for _, l := range output.Logins {
+		if l == login {
+			return
+		}
+	}
+	output.Logins = append(output.Logins, login)
+}
+
+func logOutputSummary() {
+	logInfo("Built %v image(s), skipped %v build(s), pushed %v tag(s), skipped %v tag(s)\n", len(output.Built), len(output.SkippedBuilds), len(output.Images), len(output.SkippedTags))
+	for _, s := range output.SkippedBuilds {
+		logInfo("Skipped build of %v: %v\n", s.Reference, s.Reason)
+	}
+	for _, s := range output.SkippedTags {
+		logInfo("Skipped tag %v: %v\n", s.Reference, s.Reason)
+	}
+	for _, s := range output.Signed {
+		logInfo("Signed %v\n", s)
+	}
+}
+
+func writeOutput(outputFile string) error {
+	output.Action = *action
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(inWorkingDirectory(outputFile), data, 0644)
+}
+
+type retentionRule struct {
+	pattern   *regexp.Regexp
+	retention string
+}
+
+// retentionRules are parsed from retentionPolicy once it's validated
+var retentionRules []retentionRule
+
+func validateRetentionPolicy(retentionPolicy string) {
+	for _, r := range splitPatterns(retentionPolicy) {
+		if _, err := parseRetentionRule(r); err != nil {
+			failValidation("Set `retentionPolicy:` entries as `- <regex>:keep` or `- <regex>:expire` (for example like `- ^[0-9.]+$:keep`): %v", err)
+		}
+	}
+}
+
+// parseRetentionPolicy parses the comma separated rules, patterns containing commas can be quoted
+func parseRetentionPolicy(retentionPolicy string) []retentionRule {
+	var rules []retentionRule
+	for _, r := range splitPatterns(retentionPolicy) {
+		rule, err := parseRetentionRule(r)
+		if err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseRetentionRule(rule string) (retentionRule, error) {
+	// the pattern itself can contain colons, so split on the last one
+	separatorIndex := strings.LastIndex(rule, ":")
+	if separatorIndex < 0 {
+		return retentionRule{}, fmt.Errorf("Rule %v has no :keep or :expire suffix", rule)
+	}
+	retention := rule[separatorIndex+1:]
+	if retention != "keep" && retention != "expire" {
+		return retentionRule{}, fmt.Errorf("Rule %v has retention %v instead of keep or expire", rule, retention)
+	}
+	pattern, err := regexp.Compile(rule[:separatorIndex])
+	if err != nil {
+		return retentionRule{}, fmt.Errorf("Rule %v has an invalid pattern: %v", rule, err)
+	}
+	return retentionRule{pattern: pattern, retention: retention}, nil
+}
+
+func getRetention(rules []retentionRule, tag string) string {
+	for _, r := range rules {
+		if r.pattern.MatchString(tag) {
+			return r.retention
+		}
+	}
+	return "keep"
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRetention(t *testing.T) {
+	t.Run("ReturnsRetentionOfFirstMatchingRule", func(t *testing.T) {
+
+		rules := parseRetentionPolicy(`^[0-9]+\.[0-9]+\.[0-9]+$:keep,.*:expire`)
+
+		// act
+		retention := getRetention(rules, "1.0.23")
+
+		assert.Equal(t, "keep", retention)
+	})
+
+	t.Run("ReturnsExpireForTagMatchingExpireRule", func(t *testing.T) {
+
+		rules := parseRetentionPolicy(`^[0-9]+\.[0-9]+\.[0-9]+$:keep,.*:expire`)
+
+		// act
+		retention := getRetention(rules, "0.0.187-release-release-x")
+
+		assert.Equal(t, "expire", retention)
+	})
+
+	t.Run("ReturnsKeepIfNoRuleMatches", func(t *testing.T) {
+
+		rules := parseRetentionPolicy(`^feature-:expire`)
+
+		// act
+		retention := getRetention(rules, "stable")
+
+		assert.Equal(t, "keep", retention)
+	})
+
+	t.Run("KeepsBackslashesInPattern", func(t *testing.T) {
+
+		rules := parseRetentionPolicy(`^v\d+\.\d+$:keep,.*:expire`)
+
+		// act
+		retention := getRetention(rules, "v1.2")
+
+		assert.Equal(t, "keep", retention)
+	})
+
+	t.Run("SupportsQuotedPatternWithComma", func(t *testing.T) {
+
+		rules := parseRetentionPolicy(`"^[a-f0-9]{7,12}$:expire"`)
+
+		// act
+		retention := getRetention(rules, "abc1234")
+
+		assert.Equal(t, "expire", retention)
+	})
+}
+
+func TestParseRetentionRule(t *testing.T) {
+	t.Run("ReturnsErrorForUnknownRetention", func(t *testing.T) {
+
+		// act
+		_, err := parseRetentionRule(".*:delete")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForInvalidPattern", func(t *testing.T) {
+
+		// act
+		_, err := parseRetentionRule("[:keep")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRecordLogin(t *testing.T) {
+	t.Run("RecordsEachDistinctLoginOnce", func(t *testing.T) {
+
+		output = actionOutput{}
+		defer func() { output = actionOutput{} }()
+
+		// act
+		recordLogin("gcr.io/estafette", "gcr.io", "_json_key")
+		recordLogin("gcr.io/estafette", "gcr.io", "_json_key")
+		recordLogin("extensions", "docker.io", "estafette")
+
+		assert.Equal(t, []loginOutput{
+			{Repository: "gcr.io/estafette", Server: "gcr.io", Username: "_json_key"},
+			{Repository: "extensions", Server: "docker.io", Username: "estafette"},
+		}, output.Logins)
+	})
+}
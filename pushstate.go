@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// pushStateFile records the references pushed in the work directory, which is kept between retries of a failed push
+const pushStateFile = ".estafette-extension-docker-pushed"
+
+// readPushState returns the image ids of the references recorded as pushed, or nil if nothing has been pushed yet
+func readPushState(path string) map[string]string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pushedImageIDs := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			pushedImageIDs[fields[0]] = fields[1]
+		}
+	}
+	return pushedImageIDs
+}
+
+func appendPushState(path, reference, imageID string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(reference + " " + imageID + "\n")
+	return err
+}
+
+// pushedInPreviousAttempt checks whether the reference is recorded as pushed for the same image id
+func pushedInPreviousAttempt(pushedImageIDs map[string]string, reference, imageID string) bool {
+	return imageID != "" && pushedImageIDs[reference] == imageID
+}
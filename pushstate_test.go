@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPushState(t *testing.T) {
+	t.Run("ReturnsNilIfStateFileDoesNotExist", func(t *testing.T) {
+
+		directory, _ := ioutil.TempDir("", "push-state")
+		defer os.RemoveAll(directory)
+
+		// act
+		pushedImageIDs := readPushState(filepath.Join(directory, pushStateFile))
+
+		assert.Nil(t, pushedImageIDs)
+	})
+
+	t.Run("ReturnsImageIDsOfAppendedReferences", func(t *testing.T) {
+
+		directory, _ := ioutil.TempDir("", "push-state")
+		defer os.RemoveAll(directory)
+		path := filepath.Join(directory, pushStateFile)
+		appendPushState(path, "extensions/docker:1.0.0", "sha256:abc")
+		appendPushState(path, "extensions/docker:stable", "sha256:def")
+
+		// act
+		pushedImageIDs := readPushState(path)
+
+		assert.Equal(t, map[string]string{"extensions/docker:1.0.0": "sha256:abc", "extensions/docker:stable": "sha256:def"}, pushedImageIDs)
+	})
+}
+
+func TestPushedInPreviousAttempt(t *testing.T) {
+	t.Run("ReturnsTrueIfReferenceIsRecordedForSameImageID", func(t *testing.T) {
+
+		pushedImageIDs := map[string]string{"extensions/docker:stable": "sha256:abc"}
+
+		// act
+		pushed := pushedInPreviousAttempt(pushedImageIDs, "extensions/docker:stable", "sha256:abc")
+
+		assert.True(t, pushed)
+	})
+
+	t.Run("ReturnsFalseIfReferenceIsRecordedForOtherImageID", func(t *testing.T) {
+
+		pushedImageIDs := map[string]string{"extensions/docker:stable": "sha256:abc"}
+
+		// act
+		pushed := pushedInPreviousAttempt(pushedImageIDs, "extensions/docker:stable", "sha256:def")
+
+		assert.False(t, pushed)
+	})
+
+	t.Run("ReturnsFalseIfReferenceIsNotRecorded", func(t *testing.T) {
+
+		pushedImageIDs := map[string]string{"extensions/docker:1.0.0": "sha256:abc"}
+
+		// act
+		pushed := pushedInPreviousAttempt(pushedImageIDs, "extensions/docker:stable", "sha256:abc")
+
+		assert.False(t, pushed)
+	})
+
+	t.Run("ReturnsFalseIfImageDoesNotExistLocally", func(t *testing.T) {
+
+		pushedImageIDs := map[string]string{"extensions/docker:stable": ""}
+
+		// act
+		pushed := pushedInPreviousAttempt(pushedImageIDs, "extensions/docker:stable", "")
+
+		assert.False(t, pushed)
+	})
+}
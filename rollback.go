@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	contracts "github.com/estafette/estafette-ci-contracts"
+)
+
+// tagRollback records the manifest each tag pointed to before an action pushed it, so the tags can be put back if the action fails
+// halfway; tags are changed through the registry api, registries that only delete manifests by digest, like docker hub and the
+// docker distribution registry, can't delete a single tag, so for those a warning is logged
+type tagRollback struct {
+	credentials []*contracts.ContainerRepositoryCredentialConfig
+	tags        []previousTag
+}
+
+// previousTag is the state of a tag before it was pushed; err is set if the state couldn't be retrieved
+type previousTag struct {
+	reference string
+	existed   bool
+	manifest  []byte
+	mediaType string
+	err       error
+}
+
+// activeRollback is set by actions that can undo their pushes when they fail halfway; logFatal runs it once
+var activeRollback *tagRollback
+
+// runRollbackOnFatal runs the rollback at most once, since a fatal error during the rollback itself would run it again
+func runRollbackOnFatal() {
+	if activeRollback == nil {
+		return
+	}
+	rollback := activeRollback
+	activeRollback = nil
+	rollback.rollback()
+}
+
+// recordPreviousManifest retrieves the manifest the tag points to before it's pushed; only the first push of a tag is recorded
+func (r *tagRollback) recordPreviousManifest(reference string) {
+	for _, t := range r.tags {
+		if t.reference == reference {
+			return
+		}
+	}
+	manifest, mediaType, existed, err := getRegistryManifest(getCredentialsForReference(r.credentials, reference), reference)
+	r.tags = append(r.tags, previousTag{reference: reference, existed: existed, manifest: manifest, mediaType: mediaType, err: err})
+}
+
+// rollback deletes the tags that didn't exist before and points the other tags to their previous manifest again
+func (r *tagRollback) rollback() {
+	for i := len(r.tags) - 1; i >= 0; i-- {
+		t := r.tags[i]
+		var err error
+		switch {
+		case t.err != nil:
+			err = fmt.Errorf("Retrieving its previous manifest failed: %v", t.err)
+		case t.existed:
+			logInfo("Rolling back tag %v to its previous manifest\n", t.reference)
+			err = putRegistryManifest(getCredentialsForReference(r.credentials, t.reference), t.reference, t.manifest, t.mediaType)
+		default:
+			logInfo("Rolling back tag %v by deleting it\n", t.reference)
+			err = deleteRegistryTag(getCredentialsForReference(r.credentials, t.reference), t.reference)
+		}
+		if err != nil {
+			logWarn("Rolling back tag %v failed, restore it manually: %v\n", t.reference, err)
+		}
+	}
+}
+
+// getTagManifestURL returns the registry api url of the manifest for the tag of the reference
+func getTagManifestURL(reference string) (string, error) {
+	separatorIndex := strings.LastIndex(reference, ":")
+	if separatorIndex < 0 || strings.Contains(reference[separatorIndex:], "/") {
+		return "", fmt.Errorf("Reference %v has no tag", reference)
+	}
+	name, tag := reference[:separatorIndex], reference[separatorIndex+1:]
+
+	nameSlice := strings.SplitN(name, "/", 2)
+	if len(nameSlice) == 1 || !strings.ContainsAny(nameSlice[0], ".:") && nameSlice[0] != "localhost" || nameSlice[0] == "docker.io" {
+		return "", fmt.Errorf("Docker Hub doesn't support deleting or changing tags through the registry api")
+	}
+	return fmt.Sprintf("https://%v/v2/%v/manifests/%v", nameSlice[0], nameSlice[1], tag), nil
+}
+
+// registryClient is used for all registry api requests
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// manifestMediaTypes are the manifest types accepted when retrieving a manifest, so multi platform images are retrieved as is
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// getRegistryManifest returns the manifest and its media type the tag points to, or false if the tag doesn't exist
+func getRegistryManifest(credential *contracts.ContainerRepositoryCredentialConfig, reference string) ([]byte, string, bool, error) {
+	manifestURL, err := getTagManifestURL(reference)
+	if err != nil {
+		return nil, "", false, err
+	}
+	response, err := sendRegistryRequest("GET", manifestURL, credential, nil, map[string]string{"Accept": strings.Join(manifestMediaTypes, ", ")})
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, "", false, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, "", false, fmt.Errorf("Retrieving %v failed with status %v", manifestURL, response.Status)
+	}
+	manifest, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return manifest, response.Header.Get("Content-Type"), true, nil
+}
+
+func putRegistryManifest(credential *contracts.ContainerRepositoryCredentialConfig, reference string, manifest []byte, mediaType string) error {
+	manifestURL, err := getTagManifestURL(reference)
+	if err != nil {
+		return err
+	}
+	response, err := sendRegistryRequest("PUT", manifestURL, credential, manifest, map[string]string{"Content-Type": mediaType})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Putting %v failed with status %v", manifestURL, response.Status)
+	}
+	return nil
+}
+
+func deleteRegistryTag(credential *contracts.ContainerRepositoryCredentialConfig, reference string) error {
+	manifestURL, err := getTagManifestURL(reference)
+	if err != nil {
+		return err
+	}
+	response, err := sendRegistryRequest("DELETE", manifestURL, credential, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode <= 299:
+		return nil
+	case response.StatusCode == http.StatusNotFound:
+		return nil
+	case response.StatusCode == http.StatusBadRequest || response.StatusCode == http.StatusMethodNotAllowed:
+		return fmt.Errorf("The registry doesn't support deleting tags: %v", response.Status)
+	default:
+		return fmt.Errorf("Deleting %v failed with status %v", manifestURL, response.Status)
+	}
+}
+
+// sendRegistryRequest sends the request with basic auth; registries with token auth challenge the request with the realm to get a
+// bearer token for the scope from, after which the request is sent again with the token
+func sendRegistryRequest(method, manifestURL string, credential *contracts.ContainerRepositoryCredentialConfig, body []byte, headers map[string]string) (*http.Response, error) {
+	send := func(token string) (*http.Response, error) {
+		request, err := http.NewRequest(method, manifestURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		} else if credential != nil {
+			request.SetBasicAuth(credential.Username, credential.Password)
+		}
+		return registryClient.Do(request)
+	}
+
+	response, err := send("")
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	challenge := response.Header.Get("WWW-Authenticate")
+	response.Body.Close()
+	token, err := getBearerToken(registryClient, challenge, credential)
+	if err != nil {
+		return nil, err
+	}
+	return send(token)
+}
+
+func getBearerToken(client *http.Client, challenge string, credential *contracts.ContainerRepositoryCredentialConfig) (string, error) {
+	parameters := parseBearerChallenge(challenge)
+	if parameters["realm"] == "" {
+		return "", fmt.Errorf("The registry denied access without a bearer token challenge: %v", challenge)
+	}
+	query := url.Values{}
+	for _, p := range []string{"service", "scope"} {
+		if parameters[p] != "" {
+			query.Set(p, parameters[p])
+		}
+	}
+	request, err := http.NewRequest("GET", parameters["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credential != nil {
+		request.SetBasicAuth(credential.Username, credential.Password)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("Getting a token from %v failed with status %v", parameters["realm"], response.Status)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+// parseBearerChallenge returns the parameters of a WWW-Authenticate header like Bearer realm="https://auth",service="registry",scope="..."
+func parseBearerChallenge(challenge string) map[string]string {
+	parameters := map[string]string{}
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return parameters
+	}
+	// the scope can contain commas itself, so split on the quotes
+	for _, p := range strings.Split(challenge[len("bearer "):], "\",") {
+		keyAndValue := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(keyAndValue) == 2 {
+			parameters[keyAndValue[0]] = strings.Trim(keyAndValue[1], "\"")
+		}
+	}
+	return parameters
+}
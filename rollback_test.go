@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTagManifestURL(t *testing.T) {
+	t.Run("ReturnsManifestURLForTag", func(t *testing.T) {
+
+		// act
+		manifestURL, err := getTagManifestURL("gcr.io/estafette/estafette-extension-docker:stable")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "https://gcr.io/v2/estafette/estafette-extension-docker/manifests/stable", manifestURL)
+	})
+
+	t.Run("ReturnsManifestURLForRegistryWithPort", func(t *testing.T) {
+
+		// act
+		manifestURL, err := getTagManifestURL("registry.local:5000/docker:1.0.0")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "https://registry.local:5000/v2/docker/manifests/1.0.0", manifestURL)
+	})
+
+	t.Run("ReturnsErrorForDockerHub", func(t *testing.T) {
+
+		// act
+		_, err := getTagManifestURL("extensions/docker:stable")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	t.Run("ReturnsParametersIncludingScopeWithCommas", func(t *testing.T) {
+
+		// act
+		parameters := parseBearerChallenge(`Bearer realm="https://gcr.io/v2/token",service="gcr.io",scope="repository:estafette/docker:pull,push,delete"`)
+
+		assert.Equal(t, map[string]string{"realm": "https://gcr.io/v2/token", "service": "gcr.io", "scope": "repository:estafette/docker:pull,push,delete"}, parameters)
+	})
+}
+
+func TestTagRollback(t *testing.T) {
+	t.Run("DeletesNewTagsAndRestoresExistingTags", func(t *testing.T) {
+
+		var requests []string
+		var restoredManifest string
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/manifests/stable"):
+				w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				w.Write([]byte(`{"schemaVersion":2}`))
+			case r.Method == "GET":
+				w.WriteHeader(http.StatusNotFound)
+			case r.Method == "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				restoredManifest = r.Header.Get("Content-Type") + " " + string(body)
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == "DELETE":
+				w.WriteHeader(http.StatusAccepted)
+			}
+		}))
+		defer server.Close()
+		defaultRegistryClient := registryClient
+		registryClient = server.Client()
+		defer func() { registryClient = defaultRegistryClient }()
+
+		host := strings.TrimPrefix(server.URL, "https://")
+		rollback := &tagRollback{}
+		rollback.recordPreviousManifest(host + "/estafette/docker:1.0.0")
+		rollback.recordPreviousManifest(host + "/estafette/docker:stable")
+		rollback.recordPreviousManifest(host + "/estafette/docker:stable")
+
+		// act
+		rollback.rollback()
+
+		assert.Equal(t, []string{
+			"GET /v2/estafette/docker/manifests/1.0.0",
+			"GET /v2/estafette/docker/manifests/stable",
+			"PUT /v2/estafette/docker/manifests/stable",
+			"DELETE /v2/estafette/docker/manifests/1.0.0",
+		}, requests)
+		assert.Equal(t, `application/vnd.docker.distribution.manifest.v2+json {"schemaVersion":2}`, restoredManifest)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// buildSecret is a BuildKit secret, consumed in a Dockerfile with RUN --mount=type=secret,id=<id>; a secret from a credential
+// holds its value in memory, it's never logged
+type buildSecret struct {
+	id             string
+	source         string
+	fromEnv        bool
+	fromCredential bool
+	value          string
+}
+
+// parseSecrets parses id=path and id=env:VARIABLE entries
+func parseSecrets(secrets string) ([]buildSecret, error) {
+	if secrets == "" {
+		return nil, nil
+	}
+
+	var buildSecrets []buildSecret
+	for _, s := range strings.Split(secrets, ",") {
+		idAndSource := strings.SplitN(s, "=", 2)
+		if len(idAndSource) != 2 || idAndSource[1] == "" {
+			return nil, fmt.Errorf("Secret %v is not formatted as id=path or id=env:VARIABLE", s)
+		}
+		if !regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`).MatchString(idAndSource[0]) {
+			return nil, fmt.Errorf("Secret id %v can only contain letters, digits, underscores, periods and dashes", idAndSource[0])
+		}
+
+		secret := buildSecret{id: idAndSource[0], source: idAndSource[1]}
+		if strings.HasPrefix(secret.source, "env:") {
+			secret.source = strings.TrimPrefix(secret.source, "env:")
+			secret.fromEnv = true
+		}
+		buildSecrets = append(buildSecrets, secret)
+	}
+
+	return buildSecrets, nil
+}
+
+// estafetteCredential is a credential as injected by Estafette in the ESTAFETTE_CREDENTIALS_<TYPE> environment variables
+type estafetteCredential struct {
+	Name                 string
+	Type                 string
+	AdditionalProperties map[string]interface{}
+}
+
+// parseCredentialSecrets parses id=credentialname.field entries and takes the field value from the Estafette credentials in the
+// environment; fields that aren't strings are serialized as json
+func parseCredentialSecrets(credentialSecrets string, environ []string) ([]buildSecret, error) {
+	if credentialSecrets == "" {
+		return nil, nil
+	}
+
+	var credentials []estafetteCredential
+	for _, e := range environ {
+		nameAndValue := strings.SplitN(e, "=", 2)
+		if len(nameAndValue) != 2 || !strings.HasPrefix(nameAndValue[0], "ESTAFETTE_CREDENTIALS_") {
+			continue
+		}
+		var typeCredentials []estafetteCredential
+		if err := json.Unmarshal([]byte(nameAndValue[1]), &typeCredentials); err == nil {
+			credentials = append(credentials, typeCredentials...)
+		}
+	}
+
+	var buildSecrets []buildSecret
+	for _, s := range strings.Split(credentialSecrets, ",") {
+		idAndSource := strings.SplitN(s, "=", 2)
+		if len(idAndSource) != 2 || !strings.Contains(idAndSource[1], ".") {
+			return nil, fmt.Errorf("Credential secret %v is not formatted as id=credentialname.field", s)
+		}
+		if !regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`).MatchString(idAndSource[0]) {
+			return nil, fmt.Errorf("Secret id %v can only contain letters, digits, underscores, periods and dashes", idAndSource[0])
+		}
+		nameAndField := strings.SplitN(idAndSource[1], ".", 2)
+
+		value, err := getCredentialField(credentials, nameAndField[0], nameAndField[1])
+		if err != nil {
+			return nil, err
+		}
+		// the value ends up in a temporary file for docker build, but mustn't show up in any logging
+		addRedactedValue(value)
+		buildSecrets = append(buildSecrets, buildSecret{id: idAndSource[0], source: idAndSource[1], fromCredential: true, value: value})
+	}
+
+	return buildSecrets, nil
+}
+
+func getCredentialField(credentials []estafetteCredential, name, field string) (string, error) {
+	for _, c := range credentials {
+		if c.Name != name {
+			continue
+		}
+		fieldValue, ok := c.AdditionalProperties[field]
+		if !ok {
+			return "", fmt.Errorf("Credential %v has no field %v", name, field)
+		}
+		if stringValue, ok := fieldValue.(string); ok {
+			return stringValue, nil
+		}
+		jsonValue, err := json.Marshal(fieldValue)
+		if err != nil {
+			return "", fmt.Errorf("Field %v of credential %v can't be serialized: %v", field, name, err)
+		}
+		return string(jsonValue), nil
+	}
+	return "", fmt.Errorf("Credential %v is not available, add it to the credentials of this step", name)
+}
+
+func validateSecretSources(secrets []buildSecret) error {
+	for _, s := range secrets {
+		if s.fromCredential {
+			continue
+		}
+		if s.fromEnv {
+			if os.Getenv(s.source) == "" {
+				return fmt.Errorf("Environment variable %v for secret %v is not set", s.source, s.id)
+			}
+		} else if _, err := os.Stat(inWorkingDirectory(s.source)); err != nil {
+			return fmt.Errorf("File %v for secret %v can't be read: %v", s.source, s.id, err)
+		}
+	}
+	return nil
+}
+
+// getUnconsumedSecretIDs does a best-effort check whether each secret id occurs in a --mount=type=secret in the Dockerfile
+func getUnconsumedSecretIDs(dockerfileContent string, secrets []buildSecret) []string {
+	var unconsumedSecretIDs []string
+	for _, s := range secrets {
+		consumed := false
+		for _, line := range strings.Split(dockerfileContent, "\n") {
+			if strings.Contains(line, "type=secret") && regexp.MustCompile(`id=`+regexp.QuoteMeta(s.id)+`([,\s]|$)`).MatchString(line) {
+				consumed = true
+				break
+			}
+		}
+		if !consumed {
+			unconsumedSecretIDs = append(unconsumedSecretIDs, s.id)
+		}
+	}
+	return unconsumedSecretIDs
+}
+
+// getUndeclaredSecretIDs does a best-effort parse of the ids in --mount=type=secret directives in the Dockerfile and returns
+// the ones that aren't declared as secret
+func getUndeclaredSecretIDs(dockerfileContent string, secrets []buildSecret) []string {
+	var undeclaredSecretIDs []string
+	for _, mount := range regexp.MustCompile(`--mount=(\S+)`).FindAllStringSubmatch(dockerfileContent, -1) {
+		if !strings.Contains(mount[1], "type=secret") {
+			continue
+		}
+		idMatch := regexp.MustCompile(`(^|,)id=([^,\s]+)`).FindStringSubmatch(mount[1])
+		if idMatch == nil {
+			continue
+		}
+		declared := false
+		for _, s := range secrets {
+			if s.id == idMatch[2] {
+				declared = true
+				break
+			}
+		}
+		if !declared && !contains(undeclaredSecretIDs, idMatch[2]) {
+			undeclaredSecretIDs = append(undeclaredSecretIDs, idMatch[2])
+		}
+	}
+	return undeclaredSecretIDs
+}
+
+// getSecretArgs returns the --secret arguments for docker build; secrets from environment variables or credentials are written
+// to temporary files, which the returned cleanup function removes
+func getSecretArgs(secrets []buildSecret) ([]string, func(), error) {
+	var args []string
+	var tempFiles []string
+	cleanup := func() {
+		for _, f := range tempFiles {
+			os.Remove(f)
+		}
+	}
+
+	for _, s := range secrets {
+		source := inWorkingDirectory(s.source)
+		if s.fromEnv || s.fromCredential {
+			tempFile, err := ioutil.TempFile("", "secret-")
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			tempFiles = append(tempFiles, tempFile.Name())
+			value := s.value
+			if s.fromEnv {
+				value = os.Getenv(s.source)
+			}
+			_, err = tempFile.WriteString(value)
+			tempFile.Close()
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			source = tempFile.Name()
+		}
+		args = append(args, "--secret", fmt.Sprintf("id=%v,src=%v", s.id, source))
+	}
+
+	return args, cleanup, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecrets(t *testing.T) {
+	t.Run("ReturnsSecretsFromFileAndEnvironmentVariable", func(t *testing.T) {
+
+		// act
+		secrets, err := parseSecrets("npmrc=.npmrc,github_token=env:GITHUB_TOKEN")
+
+		assert.Nil(t, err)
+		assert.Equal(t, []buildSecret{
+			{id: "npmrc", source: ".npmrc"},
+			{id: "github_token", source: "GITHUB_TOKEN", fromEnv: true},
+		}, secrets)
+	})
+
+	t.Run("ReturnsErrorIfSourceIsMissing", func(t *testing.T) {
+
+		// act
+		_, err := parseSecrets("npmrc")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfIDHasInvalidCharacters", func(t *testing.T) {
+
+		// act
+		_, err := parseSecrets("npm rc=.npmrc")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetUnconsumedSecretIDs(t *testing.T) {
+	t.Run("ReturnsNilIfAllSecretsAreMounted", func(t *testing.T) {
+
+		dockerfileContent := "FROM node:10\nRUN --mount=type=secret,id=npmrc,target=/root/.npmrc npm ci\n"
+		secrets := []buildSecret{{id: "npmrc", source: ".npmrc"}}
+
+		// act
+		unconsumed := getUnconsumedSecretIDs(dockerfileContent, secrets)
+
+		assert.Nil(t, unconsumed)
+	})
+
+	t.Run("ReturnsSecretIDsThatAreNotMounted", func(t *testing.T) {
+
+		dockerfileContent := "FROM node:10\nRUN --mount=type=secret,id=npmrc_old,target=/root/.npmrc npm ci\n"
+		secrets := []buildSecret{{id: "npmrc", source: ".npmrc"}}
+
+		// act
+		unconsumed := getUnconsumedSecretIDs(dockerfileContent, secrets)
+
+		assert.Equal(t, []string{"npmrc"}, unconsumed)
+	})
+}
+
+func TestGetUndeclaredSecretIDs(t *testing.T) {
+	t.Run("ReturnsNilIfAllMountedSecretsAreDeclared", func(t *testing.T) {
+
+		dockerfileContent := "FROM node:10\nRUN --mount=type=secret,id=npmrc,target=/root/.npmrc npm ci\n"
+		secrets := []buildSecret{{id: "npmrc", source: ".npmrc"}}
+
+		// act
+		undeclared := getUndeclaredSecretIDs(dockerfileContent, secrets)
+
+		assert.Nil(t, undeclared)
+	})
+
+	t.Run("ReturnsMountedSecretIDsThatAreNotDeclared", func(t *testing.T) {
+
+		dockerfileContent := "FROM node:10\nRUN --mount=type=cache,id=npm,target=/root/.npm --mount=type=secret,id=npmrc_old,target=/root/.npmrc npm ci\n"
+		secrets := []buildSecret{{id: "npmrc", source: ".npmrc"}}
+
+		// act
+		undeclared := getUndeclaredSecretIDs(dockerfileContent, secrets)
+
+		assert.Equal(t, []string{"npmrc_old"}, undeclared)
+	})
+}
+
+func TestParseCredentialSecrets(t *testing.T) {
+	t.Run("ReturnsSecretWithCredentialFieldValue", func(t *testing.T) {
+
+		environ := []string{`ESTAFETTE_CREDENTIALS_GITHUB_API_TOKEN=[{"name":"github-api-token","type":"github-api-token","additionalProperties":{"token":"abc123"}}]`}
+
+		// act
+		secrets, err := parseCredentialSecrets("github_token=github-api-token.token", environ)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []buildSecret{{id: "github_token", source: "github-api-token.token", fromCredential: true, value: "abc123"}}, secrets)
+	})
+
+	t.Run("RedactsCredentialFieldValueInLogging", func(t *testing.T) {
+
+		redactedValues = nil
+		defer func() { redactedValues = nil }()
+		environ := []string{`ESTAFETTE_CREDENTIALS_GITHUB_API_TOKEN=[{"name":"github-api-token","type":"github-api-token","additionalProperties":{"token":"abc123"}}]`}
+
+		// act
+		_, err := parseCredentialSecrets("github_token=github-api-token.token", environ)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "Using token ***", redact("Using token abc123"))
+	})
+
+	t.Run("ReturnsSecretWithJSONForNonStringField", func(t *testing.T) {
+
+		environ := []string{`ESTAFETTE_CREDENTIALS_NPM=[{"name":"npm","type":"npm","additionalProperties":{"registries":["registry.npmjs.org"]}}]`}
+
+		// act
+		secrets, err := parseCredentialSecrets("npm_registries=npm.registries", environ)
+
+		assert.Nil(t, err)
+		assert.Equal(t, `["registry.npmjs.org"]`, secrets[0].value)
+	})
+
+	t.Run("ReturnsErrorIfCredentialIsNotAvailable", func(t *testing.T) {
+
+		// act
+		_, err := parseCredentialSecrets("github_token=github-api-token.token", []string{})
+
+		assert.NotNil(t, err)
+	})
+}
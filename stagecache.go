@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	contracts "github.com/estafette/estafette-ci-contracts"
+)
+
+// getBuildStages returns the named intermediate stages of a Dockerfile; the final stage is the image itself, so it's never included
+func getBuildStages(dockerfileContent string) []string {
+	var stages []string
+	finalStage := ""
+	for _, line := range strings.Split(dockerfileContent, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// skip flags like --platform
+		var imageAndStage []string
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "--") {
+				imageAndStage = append(imageAndStage, f)
+			}
+		}
+		if finalStage != "" && !contains(stages, finalStage) {
+			stages = append(stages, finalStage)
+		}
+		finalStage = ""
+		if len(imageAndStage) == 3 && strings.EqualFold(imageAndStage[1], "AS") {
+			finalStage = strings.ToLower(imageAndStage[2])
+		}
+	}
+	return stages
+}
+
+// getStageCacheReference returns the reference of the cache image for a stage, tagged per dockerfile since build groups with
+// different dockerfiles can have stages with the same name; a tag can't start with a period or dash, so those are trimmed from the
+// dockerfile path, like the ./ of ./Dockerfile.build
+func getStageCacheReference(registry, container, dockerfile, stage string) string {
+	dockerfileTag := strings.TrimLeft(tidyBuildVersionAsTag(strings.TrimPrefix(dockerfile, "./")), ".-")
+	return fmt.Sprintf("%v/%v:%v-%v", strings.TrimSuffix(registry, "/"), container, dockerfileTag, stage)
+}
+
+// getStageCacheArgs returns the docker build arguments to embed the inline cache metadata and use the cache images of the stages,
+// and the references of those cache images
+func getStageCacheArgs(registry, container, dockerfile string, stages []string) ([]string, []string) {
+	args := []string{"--build-arg", "BUILDKIT_INLINE_CACHE=1"}
+	var references []string
+	for _, s := range stages {
+		reference := getStageCacheReference(registry, container, dockerfile, s)
+		references = append(references, reference)
+		args = append(args, "--cache-from", reference)
+	}
+	return args, references
+}
+
+// getStageBuildArgs returns the docker build arguments to build only the stage, tagged with its cache reference
+func getStageBuildArgs(args []string, stage, stageCacheReference string) []string {
+	return getDebugBuildArgs(args, stage, []string{stageCacheReference})
+}
+
+// pushStageCache builds each intermediate stage with the inline cache metadata and pushes it to the stage cache registry, for the
+// next build to use with --cache-from; the stages are cached by the build that just ran, and failures are only logged since the
+// image itself has been built
+func pushStageCache(credentials []*contracts.ContainerRepositoryCredentialConfig, b groupBuild) {
+	dockerfileContent, err := readDockerfile(b.dockerfileInput, b.dockerfile)
+	handleError(err)
+	container := getRepositoryContainer(b.repositories[0])
+
+	for _, s := range getBuildStages(string(dockerfileContent)) {
+		stageCacheReference := getStageCacheReference(*stageCacheRegistry, container, b.dockerfile, s)
+
+		logInfo("Building stage %v of %v for the stage cache\n", s, b.dockerfile)
+		stageBuild := b
+		stageBuild.args = getStageBuildArgs(b.args, s, stageCacheReference)
+		if err := runBuild(stageBuild, os.Stdout, os.Stderr); err != nil {
+			logWarn("Building stage %v of %v failed: %v\n", s, b.dockerfile, err)
+			continue
+		}
+
+		loginForReference(credentials, stageCacheReference)
+		logInfo("Pushing stage cache image %v\n", stageCacheReference)
+		if err := dockerCommand("push", stageCacheReference).Run(); err != nil {
+			logWarn("Pushing stage cache image %v failed: %v\n", stageCacheReference, err)
+		}
+	}
+}
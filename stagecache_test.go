@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBuildStages(t *testing.T) {
+	t.Run("ReturnsNamedStagesExceptFinalStage", func(t *testing.T) {
+
+		dockerfileContent := "FROM --platform=linux/amd64 golang:1.11 AS Builder\nRUN go build\n\nFROM node:10 AS assets\nRUN npm run build\n\nFROM alpine:3.8 AS runtime\nCOPY --from=builder /app /app\n"
+
+		// act
+		stages := getBuildStages(dockerfileContent)
+
+		assert.Equal(t, []string{"builder", "assets"}, stages)
+	})
+
+	t.Run("ReturnsNoStagesForSingleStageDockerfile", func(t *testing.T) {
+
+		// act
+		stages := getBuildStages("FROM alpine:3.8\nCOPY . .\n")
+
+		assert.Empty(t, stages)
+	})
+}
+
+func TestGetStageCacheReference(t *testing.T) {
+	t.Run("ReturnsReferenceTaggedWithDockerfileAndStage", func(t *testing.T) {
+
+		// act
+		reference := getStageCacheReference("cache.registry.io/estafette/", "docker", "build/Dockerfile", "builder")
+
+		assert.Equal(t, "cache.registry.io/estafette/docker:build-Dockerfile-builder", reference)
+	})
+
+	t.Run("ReturnsValidReferenceForDockerfileInCurrentDirectory", func(t *testing.T) {
+
+		// act
+		reference := getStageCacheReference("cache.registry.io/estafette", "docker", "./Dockerfile.build", "builder")
+
+		assert.Equal(t, "cache.registry.io/estafette/docker:Dockerfile.build-builder", reference)
+		assert.True(t, isValidReferenceWithTag(reference))
+	})
+
+	t.Run("ReturnsValidReferenceForDockerfileInParentDirectory", func(t *testing.T) {
+
+		// act
+		reference := getStageCacheReference("cache.registry.io/estafette", "docker", "../build/Dockerfile", "builder")
+
+		assert.Equal(t, "cache.registry.io/estafette/docker:build-Dockerfile-builder", reference)
+		assert.True(t, isValidReferenceWithTag(reference))
+	})
+}
+
+func TestGetStageCacheArgs(t *testing.T) {
+	t.Run("ReturnsInlineCacheArgAndCacheFromPerStage", func(t *testing.T) {
+
+		// act
+		args, references := getStageCacheArgs("cache.registry.io/estafette", "docker", "Dockerfile", []string{"builder", "assets"})
+
+		assert.Equal(t, []string{
+			"--build-arg", "BUILDKIT_INLINE_CACHE=1",
+			"--cache-from", "cache.registry.io/estafette/docker:Dockerfile-builder",
+			"--cache-from", "cache.registry.io/estafette/docker:Dockerfile-assets",
+		}, args)
+		assert.Equal(t, []string{"cache.registry.io/estafette/docker:Dockerfile-builder", "cache.registry.io/estafette/docker:Dockerfile-assets"}, references)
+	})
+}
+
+func TestGetStageBuildArgs(t *testing.T) {
+	t.Run("BuildsTargetStageTaggedWithCacheReferenceKeepingCacheArgs", func(t *testing.T) {
+
+		args := []string{"build", "--tag", "extensions/docker:1.0.0", "--build-arg", "BUILDKIT_INLINE_CACHE=1", "--cache-from", "cache.registry.io/estafette/docker:Dockerfile-builder", "--file", "./Dockerfile", "."}
+
+		// act
+		stageArgs := getStageBuildArgs(args, "builder", "cache.registry.io/estafette/docker:Dockerfile-builder")
+
+		assert.Equal(t, []string{"build", "--build-arg", "BUILDKIT_INLINE_CACHE=1", "--cache-from", "cache.registry.io/estafette/docker:Dockerfile-builder", "--file", "./Dockerfile", "--target", "builder", "--tag", "cache.registry.io/estafette/docker:Dockerfile-builder", "."}, stageArgs)
+	})
+}